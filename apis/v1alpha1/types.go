@@ -0,0 +1,97 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group    = "ratelimit.istio-conductor.io"
+	Version  = "v1alpha1"
+	Kind     = "RateLimitConfig"
+	Resource = "ratelimitconfigs"
+)
+
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// RateLimitConfig is a domain config, the spec mirrors the yaml config files.
+type RateLimitConfig struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RateLimitConfigSpec   `json:"spec"`
+	Status RateLimitConfigStatus `json:"status,omitempty"`
+}
+
+type RateLimitConfigSpec struct {
+	Domain            string                    `json:"domain" yaml:"domain"`
+	Merge             bool                      `json:"merge,omitempty" yaml:"merge,omitempty"`
+	Backend           string                    `json:"backend,omitempty" yaml:"backend,omitempty"`
+	Zones             *ZoneSplit                `json:"zones,omitempty" yaml:"zones,omitempty"`
+	Limits            map[string]*RateLimitSpec `json:"limits,omitempty" yaml:"limits,omitempty"`
+	DefaultDescriptor *DefaultDescriptorSpec    `json:"default_descriptor,omitempty" yaml:"default_descriptor,omitempty"`
+	Descriptors       []DescriptorSpec          `json:"descriptors,omitempty" yaml:"descriptors,omitempty"`
+}
+
+type DefaultDescriptorSpec struct {
+	RateLimit    *RateLimitSpec `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateLimitRef string         `json:"rate_limit_ref,omitempty" yaml:"rate_limit_ref,omitempty"`
+}
+
+type ZoneSplit struct {
+	Split   string             `json:"split" yaml:"split"`
+	Weights map[string]float64 `json:"weights,omitempty" yaml:"weights,omitempty"`
+}
+
+type DescriptorSpec struct {
+	Key          string            `json:"key" yaml:"key"`
+	Value        string            `json:"value,omitempty" yaml:"value,omitempty"`
+	RateLimit    *RateLimitSpec    `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateLimitRef string            `json:"rate_limit_ref,omitempty" yaml:"rate_limit_ref,omitempty"`
+	Schedules    []ScheduleSpec    `json:"schedules,omitempty" yaml:"schedules,omitempty"`
+	Allow        []string          `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny         []string          `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Penalty      *PenaltySpec      `json:"penalty,omitempty" yaml:"penalty,omitempty"`
+	MaxWait      string            `json:"max_wait,omitempty" yaml:"max_wait,omitempty"`
+	Cost         uint32            `json:"cost,omitempty" yaml:"cost,omitempty"`
+	CostByValue  map[string]uint32 `json:"cost_by_value,omitempty" yaml:"cost_by_value,omitempty"`
+	Descriptors  []DescriptorSpec  `json:"descriptors,omitempty" yaml:"descriptors,omitempty"`
+}
+
+type PenaltySpec struct {
+	Violations int    `json:"violations" yaml:"violations"`
+	Window     string `json:"window" yaml:"window"`
+	Ban        string `json:"ban" yaml:"ban"`
+	MaxBan     string `json:"max_ban,omitempty" yaml:"max_ban,omitempty"`
+}
+
+type ScheduleSpec struct {
+	Name         string         `json:"name" yaml:"name"`
+	Hours        string         `json:"hours,omitempty" yaml:"hours,omitempty"`
+	Days         []string       `json:"days,omitempty" yaml:"days,omitempty"`
+	From         string         `json:"from,omitempty" yaml:"from,omitempty"`
+	To           string         `json:"to,omitempty" yaml:"to,omitempty"`
+	Timezone     string         `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	RateLimit    *RateLimitSpec `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	RateLimitRef string         `json:"rate_limit_ref,omitempty" yaml:"rate_limit_ref,omitempty"`
+}
+
+type RateLimitSpec struct {
+	RequestsPerUnit uint32 `json:"requests_per_unit,omitempty" yaml:"requests_per_unit,omitempty"`
+	Unit            string `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Requests        uint32 `json:"requests,omitempty" yaml:"requests,omitempty"`
+	Interval        string `json:"interval,omitempty" yaml:"interval,omitempty"`
+}
+
+const (
+	ConditionLoaded = "Loaded"
+
+	ReasonLoaded   = "Loaded"
+	ReasonInvalid  = "Invalid"
+	ReasonLastGood = "LastKnownGood"
+)
+
+type RateLimitConfigStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
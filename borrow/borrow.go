@@ -0,0 +1,189 @@
+package borrow
+
+import (
+	"context"
+	"fmt"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"github.com/istio-conductor/shard-ratelimit/replicas"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Path = "/borrow"
+
+// Lender hands out up to n unused tokens of the local shard for key.
+type Lender interface {
+	Lend(key string, n int) int
+}
+
+type lease struct {
+	tokens  int
+	expire  time.Time
+	pending bool
+}
+
+// Borrower borrows unused tokens from peer replicas when the local shard of a key is exhausted.
+// Borrowed tokens are kept as a lease which expires after a while, so they never outlive the
+// window they were taken from.
+type Borrower struct {
+	self    string
+	port    int
+	peers   func() []string
+	client  *http.Client
+	timeout time.Duration
+	ttl     time.Duration
+	size    int
+	token   string
+
+	mu     sync.Mutex
+	leases map[string]*lease
+}
+
+func New(self string, port int, peers func() []string, timeout, ttl time.Duration, size int) *Borrower {
+	if size <= 0 {
+		size = 1
+	}
+	return &Borrower{
+		self:    self,
+		port:    port,
+		peers:   peers,
+		client:  &http.Client{Timeout: timeout},
+		timeout: timeout,
+		ttl:     ttl,
+		size:    size,
+		leases:  map[string]*lease{},
+	}
+}
+
+// WithToken authenticates the requests to the peers with the shared token of the replicas.
+func (b *Borrower) WithToken(token string) *Borrower {
+	b.token = token
+	return b
+}
+
+// Borrow takes n tokens for key from a lease, asking a peer for a new lease when needed. A lease holds at
+// least n tokens, the peers may grant fewer, which are added to the lease for the next smaller request.
+func (b *Borrower) Borrow(ctx context.Context, key string, n int) bool {
+	now := time.Now()
+	b.mu.Lock()
+	l := b.leases[key]
+	if l == nil {
+		l = &lease{}
+		b.leases[key] = l
+	}
+	if l.tokens >= n && now.Before(l.expire) {
+		l.tokens -= n
+		b.mu.Unlock()
+		return true
+	}
+	if l.pending {
+		// another request is already asking the peers, don't pile up on them.
+		b.mu.Unlock()
+		return false
+	}
+	l.pending = true
+	b.mu.Unlock()
+
+	size := b.size
+	if n > size {
+		size = n
+	}
+	granted := b.request(ctx, key, size)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l.pending = false
+	// the tokens left on the lease are kept while it lasts, only a grant extends it.
+	if !time.Now().Before(l.expire) {
+		l.tokens = 0
+	}
+	if granted > 0 {
+		l.tokens += granted
+		l.expire = now.Add(b.ttl)
+	}
+	if l.tokens < n {
+		prom.BorrowFailed.Inc()
+		return false
+	}
+	prom.BorrowSuccess.Inc()
+	l.tokens -= n
+	return true
+}
+
+func (b *Borrower) candidates() []string {
+	var peers []string
+	for _, peer := range b.peers() {
+		if peer != b.self {
+			peers = append(peers, peer)
+		}
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	return peers
+}
+
+func (b *Borrower) request(ctx context.Context, key string, n int) int {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	for _, peer := range b.candidates() {
+		if ctx.Err() != nil {
+			return 0
+		}
+		granted, err := b.ask(ctx, peer, key, n)
+		if err != nil {
+			log.Debug().Err(err).Msgf("borrow from %s failed", peer)
+			continue
+		}
+		if granted > 0 {
+			return granted
+		}
+	}
+	return 0
+}
+
+func (b *Borrower) ask(ctx context.Context, peer string, key string, n int) (int, error) {
+	query := url.Values{"key": {key}, "n": {strconv.Itoa(n)}}
+	u := "http://" + net.JoinHostPort(peer, strconv.Itoa(b.port)) + Path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	replicas.Authorize(req, b.token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", peer, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// Handler serves borrow requests of the peers from lender.
+func Handler(lender Lender) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		key := request.URL.Query().Get("key")
+		n, err := strconv.Atoi(request.URL.Query().Get("n"))
+		if key == "" || err != nil || n <= 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		granted := lender.Lend(key, n)
+		prom.LendTokens.Add(float64(granted))
+		_, _ = writer.Write([]byte(strconv.Itoa(granted)))
+	})
+}
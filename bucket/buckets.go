@@ -3,17 +3,59 @@ package bucket
 import (
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/prom"
 	"golang.org/x/net/context"
 	"golang.org/x/time/rate"
-	"math"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Borrower takes n tokens for key from the peers once the local shard is exhausted.
+type Borrower interface {
+	Borrow(ctx context.Context, key string, n int) bool
+}
+
+type bucket struct {
+	*rate.Limiter
+	used int64
+}
+
 type Buckets struct {
-	limiter map[string]*rate.Limiter
+	// limiter holds the map[string]*bucket, swapped by Update while the requests and the peers read it.
+	limiter  atomic.Value
+	update   sync.Mutex
+	borrower Borrower
+	count    bool
+	// waiters holds a slot per request waiting for a token.
+	waiters chan struct{}
 }
 
 func New() *Buckets {
-	return &Buckets{map[string]*rate.Limiter{}}
+	b := &Buckets{waiters: make(chan struct{}, DefaultMaxWaiters)}
+	b.limiter.Store(map[string]*bucket{})
+	return b
+}
+
+func (b *Buckets) buckets() map[string]*bucket {
+	return b.limiter.Load().(map[string]*bucket)
+}
+
+func (b *Buckets) get(key string) (*bucket, bool) {
+	l, ok := b.buckets()[key]
+	return l, ok
+}
+
+// WithCounting makes the buckets count the consumed tokens for Consumed.
+func (b *Buckets) WithCounting() *Buckets {
+	b.count = true
+	return b
+}
+
+// WithBorrower enables borrowing tokens from peers before returning OVER_LIMIT.
+func (b *Buckets) WithBorrower(borrower Borrower) *Buckets {
+	b.borrower = borrower
+	return b
 }
 
 var (
@@ -28,27 +70,70 @@ var (
 	}
 )
 
-func (b *Buckets) Update(limits map[string]float64) {
-	m := make(map[string]*rate.Limiter, len(limits))
-	for k, f := range limits {
-		m[k] = rate.NewLimiter(rate.Limit(f), int(math.Ceil(f)))
+func (b *Buckets) Update(limits map[string]config.KeyLimit) {
+	b.update.Lock()
+	defer b.update.Unlock()
+	current := b.buckets()
+	m := make(map[string]*bucket, len(limits))
+	now := time.Now()
+	for k, limit := range limits {
+		// keep the state of the existing buckets, only their limits change.
+		if l, ok := current[k]; ok {
+			if l.Limit() != rate.Limit(limit.Rate) {
+				l.SetLimitAt(now, rate.Limit(limit.Rate))
+			}
+			if l.Burst() != limit.Burst {
+				l.SetBurstAt(now, limit.Burst)
+			}
+			m[k] = l
+			continue
+		}
+		m[k] = &bucket{Limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
 	}
-	b.limiter = m
+	b.limiter.Store(m)
+}
+
+// Listed returns the status of a limit decided by an allow or deny list, nil when the limit is checked.
+func Listed(domain string, limit *config.RateLimit) *pb.RateLimitResponse_DescriptorStatus {
+	switch limit.Access {
+	case config.AccessAllow:
+		prom.ListHits.WithLabelValues(domain, string(limit.Access)).Inc()
+		return OK
+	case config.AccessDeny:
+		prom.ListHits.WithLabelValues(domain, string(limit.Access)).Inc()
+		return FAIL
+	}
+	return nil
 }
 
 func (b *Buckets) DoLimit(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
 	resp := make([]*pb.RateLimitResponse_DescriptorStatus, 0, len(limits))
-	for _, limit := range limits {
+	for i, limit := range limits {
 		if limit == nil {
 			resp = append(resp, UNKNOWN)
 			continue
 		}
-		l, ok := b.limiter[limit.FullKey]
+		if status := Listed(request.Domain, limit); status != nil {
+			resp = append(resp, status)
+			continue
+		}
+		l, ok := b.get(limit.FullKey)
 		if !ok {
 			resp = append(resp, UNKNOWN)
 			continue
 		}
-		if l.Allow() {
+		n := int(limit.Consumption(request.Descriptors[i], request.HitsAddend))
+		if l.AllowN(time.Now(), n) {
+			if b.count {
+				atomic.AddInt64(&l.used, int64(n))
+			}
+			resp = append(resp, OK)
+		} else if b.borrower != nil && b.borrower.Borrow(ctx, limit.FullKey, n) {
+			resp = append(resp, OK)
+		} else if limit.MaxWait > 0 && b.wait(ctx, l, n, limit.MaxWait) {
+			if b.count {
+				atomic.AddInt64(&l.used, int64(n))
+			}
 			resp = append(resp, OK)
 		} else {
 			resp = append(resp, FAIL)
@@ -56,3 +141,57 @@ func (b *Buckets) DoLimit(ctx context.Context, request *pb.RateLimitRequest, lim
 	}
 	return resp
 }
+
+// Lend gives away up to n tokens of the local shard for key, halving the amount until
+// the bucket can afford it.
+func (b *Buckets) Lend(key string, n int) int {
+	l, ok := b.get(key)
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	for ; n > 0; n /= 2 {
+		if l.AllowN(now, n) {
+			if b.count {
+				atomic.AddInt64(&l.used, int64(n))
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// Consumed returns the tokens consumed per key since the last call.
+func (b *Buckets) Consumed() map[string]int64 {
+	m := map[string]int64{}
+	for k, l := range b.buckets() {
+		if used := atomic.SwapInt64(&l.used, 0); used > 0 {
+			m[k] = used
+		}
+	}
+	return m
+}
+
+// Rate returns the local tokens per second of key.
+func (b *Buckets) Rate(key string) float64 {
+	l, ok := b.get(key)
+	if !ok {
+		return 0
+	}
+	return float64(l.Limit())
+}
+
+// Penalize takes n tokens from the bucket of key ahead of time, reducing the allowance to come.
+func (b *Buckets) Penalize(key string, n int) {
+	l, ok := b.get(key)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	for burst := l.Burst(); n > 0 && burst > 0; n -= burst {
+		if n < burst {
+			burst = n
+		}
+		l.ReserveN(now, burst)
+	}
+}
@@ -0,0 +1,140 @@
+package bucket
+
+import (
+	"container/list"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPenaltyEntries is the default number of values the penalties remember.
+const DefaultPenaltyEntries = 100000
+
+// Ban is a value of a descriptor rejected until Until.
+type Ban struct {
+	Descriptor string    `json:"descriptor"`
+	Value      string    `json:"value"`
+	Until      time.Time `json:"until"`
+	// Bans counts the bans of the value, which escalate.
+	Bans int `json:"bans"`
+}
+
+type offender struct {
+	descriptor  string
+	value       string
+	violations  int
+	windowStart time.Time
+	bannedUntil time.Time
+	bans        int
+}
+
+// Penalties tracks the violations and bans of the values of descriptors with a penalty. It remembers up
+// to max values, forgetting the least recently seen ones first.
+type Penalties struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func NewPenalties(max int) *Penalties {
+	if max <= 0 {
+		max = DefaultPenaltyEntries
+	}
+	return &Penalties{max: max, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func penaltyKey(descriptor, value string) string {
+	return descriptor + "|" + value
+}
+
+// Banned reports whether the value of the descriptor is banned at now.
+func (p *Penalties) Banned(descriptor, value string, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[penaltyKey(descriptor, value)]
+	if !ok {
+		return false
+	}
+	p.lru.MoveToFront(e)
+	return now.Before(e.Value.(*offender).bannedUntil)
+}
+
+// Violation records an over limit answer of the value of the descriptor, banning it once it has more than
+// the violations of the penalty within its window.
+func (p *Penalties) Violation(descriptor, value string, penalty *config.Penalty, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := penaltyKey(descriptor, value)
+	var o *offender
+	if e, ok := p.entries[key]; ok {
+		p.lru.MoveToFront(e)
+		o = e.Value.(*offender)
+	} else {
+		o = &offender{descriptor: descriptor, value: value, windowStart: now}
+		p.entries[key] = p.lru.PushFront(o)
+		p.evict()
+	}
+	if now.Before(o.bannedUntil) {
+		return
+	}
+	if now.Sub(o.windowStart) >= penalty.Window {
+		o.windowStart = now
+		o.violations = 0
+	}
+	// the bans escalate while the value offends again within the longest ban after the previous one.
+	if o.bans > 0 && now.Sub(o.bannedUntil) >= penalty.MaxBan {
+		o.bans = 0
+	}
+	o.violations++
+	if o.violations <= penalty.Violations {
+		return
+	}
+	o.bannedUntil = now.Add(penalty.BanFor(o.bans))
+	o.bans++
+	o.violations = 0
+	o.windowStart = o.bannedUntil
+	prom.PenaltyBans.WithLabelValues(descriptor).Inc()
+}
+
+func (p *Penalties) evict() {
+	for p.lru.Len() > p.max {
+		e := p.lru.Back()
+		o := p.lru.Remove(e).(*offender)
+		delete(p.entries, penaltyKey(o.descriptor, o.value))
+		prom.PenaltyEvicted.Inc()
+	}
+}
+
+// Lift ends the ban of the value of the descriptor, reporting whether it was banned.
+func (p *Penalties) Lift(descriptor, value string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := penaltyKey(descriptor, value)
+	e, ok := p.entries[key]
+	if !ok {
+		return false
+	}
+	p.lru.Remove(e)
+	delete(p.entries, key)
+	return true
+}
+
+// Bans returns the bans active at now, the longest first.
+func (p *Penalties) Bans(now time.Time) []Ban {
+	p.mu.Lock()
+	var bans []Ban
+	for e := p.lru.Front(); e != nil; e = e.Next() {
+		o := e.Value.(*offender)
+		if now.Before(o.bannedUntil) {
+			bans = append(bans, Ban{Descriptor: o.descriptor, Value: o.value, Until: o.bannedUntil, Bans: o.bans})
+		}
+	}
+	p.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.After(bans[j].Until)
+	})
+	return bans
+}
@@ -0,0 +1,55 @@
+package bucket
+
+import (
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// DefaultMaxWaiters is the default number of requests waiting for a token at once.
+const DefaultMaxWaiters = 1000
+
+// WithMaxWaiters bounds the requests waiting for a token at once, the others get OVER_LIMIT.
+func (b *Buckets) WithMaxWaiters(max int) *Buckets {
+	b.waiters = make(chan struct{}, max)
+	return b
+}
+
+// wait reserves the next n tokens of l and waits for them, up to maxWait and within the deadline of ctx,
+// reporting whether it got the tokens.
+func (b *Buckets) wait(ctx context.Context, l *bucket, n int, maxWait time.Duration) bool {
+	now := time.Now()
+	if deadline, ok := ctx.Deadline(); ok && deadline.Sub(now) < maxWait {
+		maxWait = deadline.Sub(now)
+	}
+	r := l.ReserveN(now, n)
+	if !r.OK() {
+		return false
+	}
+	delay := r.DelayFrom(now)
+	if delay > maxWait {
+		r.CancelAt(now)
+		return false
+	}
+	select {
+	case b.waiters <- struct{}{}:
+	default:
+		r.CancelAt(now)
+		prom.QueueFull.Inc()
+		return false
+	}
+	defer func() { <-b.waiters }()
+	prom.QueueWaiters.Inc()
+	defer prom.QueueWaiters.Dec()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		prom.QueueWaited.Observe(float64(delay.Milliseconds()))
+		return true
+	case <-ctx.Done():
+		r.Cancel()
+		return false
+	}
+}
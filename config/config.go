@@ -1,13 +1,18 @@
 package config
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // RateLimit is a wrapper for an individual rate limit config entry which includes the defined limit and metrics.
@@ -15,6 +20,25 @@ type RateLimit struct {
 	FullKey string
 	Metrics Metrics
 	Limit   *pb.RateLimitResponse_RateLimit
+	// RequestsPerUnit is the configured limit before the division by replicas, per Interval.
+	RequestsPerUnit uint32
+	Interval        time.Duration
+	// PerReplica is the part of RequestsPerUnit of this replica.
+	PerReplica float64
+	// Access is set when an allow or deny list decides the status instead of the limit.
+	Access Access
+	// Penalty bans the values going over the limit too often.
+	Penalty *Penalty
+	// MaxWait is how long a request may wait for a token of the local buckets instead of going over limit.
+	MaxWait time.Duration
+	// Cost is the tokens a hit consumes, 1 when zero, unless CostByValue has the value of the entry.
+	Cost        uint32
+	CostByValue map[string]uint32
+}
+
+// Equal reports whether both limits allow the same.
+func (l *RateLimit) Equal(other *RateLimit) bool {
+	return l.RequestsPerUnit == other.RequestsPerUnit && l.Interval == other.Interval
 }
 
 type DebugLimit RateLimit
@@ -23,7 +47,10 @@ func (l *DebugLimit) String() string {
 	if l == nil {
 		return ""
 	}
-	return strconv.FormatInt(int64(l.Limit.RequestsPerUnit), 10) + "/" + l.Limit.Unit.String()
+	if l.Access != "" {
+		return string(l.Access)
+	}
+	return strconv.FormatInt(int64(l.RequestsPerUnit), 10) + "/" + (*RateLimit)(l).Per()
 }
 
 type File struct {
@@ -38,149 +65,591 @@ var (
 	ErrDuplicateDescriptor          = errors.New("duplicate descriptor")
 	ErrInvalidUnit                  = errors.New("invalid unit")
 	ErrUnsupportedRateLimitOverride = errors.New("unsupported ratelimit override")
+	ErrInvalidBackend               = errors.New("invalid backend")
+	ErrInvalidZoneSplit             = errors.New("invalid zone split")
+	ErrInvalidZoneWeight            = errors.New("zone weight must be positive")
+	ErrFractionalShare              = errors.New("limit divides to less than a request per replica, each replica admits a whole request at first")
+	ErrCostOverBurst                = errors.New("cost of a hit exceeds the share of a replica, the burst of the replica is raised to the cost")
+	ErrConflictingLimit             = errors.New("descriptor is defined with a different limit")
+	ErrUnknownLimitRef              = errors.New("rate_limit_ref refers to an unknown limit")
+	ErrAmbiguousLimit               = errors.New("descriptor sets both rate_limit and rate_limit_ref")
+	ErrNoDefaultLimit               = errors.New("default_descriptor needs rate_limit or rate_limit_ref")
+	ErrInvalidLimit                 = errors.New("limit must be like 100/second")
+	ErrInvalidMaxWait               = errors.New("max_wait must be a positive duration")
+)
+
+const (
+	BackendLocal = "local"
+	BackendRedis = "redis"
 )
 
 type Config struct {
-	domains map[string]*Domain
+	domains  map[string]*Domain
+	topology Topology
+	// failed holds the domains of the files which failed to load.
+	failed map[string]bool
+	// tables are the parsed value tables shared with the configs built from this one.
+	tables *TableCache
 }
 
 // NewRateLimit Create a new rate limit config entry.
 func NewRateLimit(
 	requestsPerUnit uint32, unit pb.RateLimitResponse_RateLimit_Unit, key string) *RateLimit {
-	return &RateLimit{FullKey: key, Metrics: NewMetrics(key), Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: requestsPerUnit, Unit: unit}}
+	return &RateLimit{FullKey: key, Metrics: NewMetrics(key), RequestsPerUnit: requestsPerUnit, Interval: unitIntervals[unit], PerReplica: float64(requestsPerUnit),
+		Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: requestsPerUnit, Unit: unit}}
 }
 
 type Descriptor struct {
-	Key         string
+	Key string
+	// EntryKey and EntryValue are the descriptor entry matched, the value is empty for any value.
+	EntryKey    string
+	EntryValue  string
 	FullKey     string
 	Descriptors map[string]*Descriptor
 	Limit       *RateLimit
+	// Schedules replace Limit while they are active.
+	Schedules []*Schedule
+	override  *override
+	// Table holds the limits of the values of a key only descriptor, Limit applies to the other values.
+	Table *Table
+	// Allow and Deny decide the status of the values they contain, before any limit.
+	Allow *List
+	Deny  *List
+	// Penalty, MaxWait and the costs are set on all the limits of the descriptor.
+	Penalty     *Penalty
+	MaxWait     time.Duration
+	Cost        uint32
+	CostByValue map[string]uint32
+	// File and Line locate the definition of the descriptor.
+	File string
+	Line int
 }
 
-func (d *Descriptor) KeyLimits(keys map[string]float64) {
-	if d.Limit != nil {
-		keys[d.Limit.FullKey] = float64(int(d.Limit.Limit.RequestsPerUnit))
+func (d *Descriptor) KeyLimits(keys map[string]KeyLimit, t time.Time) {
+	if limit, _ := d.limitAt(t); limit != nil {
+		keys[limit.FullKey] = limit.keyLimit()
+	}
+	if d.Table != nil {
+		for _, limit := range d.Table.limits {
+			keys[limit.FullKey] = limit.keyLimit()
+		}
 	}
 	for _, child := range d.Descriptors {
-		child.KeyLimits(keys)
+		child.KeyLimits(keys, t)
 	}
 }
 
 type Domain struct {
 	Descriptor
+	Backend string
+	Zones   *ZoneSplit
+	File    string
+	// Merge lets other files with merge set contribute descriptors to the domain.
+	Merge bool
+	// Default limits the descriptors without a limit of their own, all of them share its bucket.
+	Default *Descriptor
 }
 
-// Load a set of config descriptors from the YAML file and check the input.
-func (d *Descriptor) loadDescriptors(descriptors []yamlDescriptor) error {
-	for _, conf := range descriptors {
-		descriptor, err := conf.ToDescriptor(d)
+// DefaultDescriptor is the key of the default descriptor of a domain.
+const DefaultDescriptor = "default_descriptor"
+
+func (d *Domain) loadDefault(l *loader, y *yamlDefaultDescriptor, node *yaml.Node) {
+	if y == nil {
+		return
+	}
+	key := d.FullKey + "." + DefaultDescriptor
+	limit, err := l.rateLimit(node, y.RateLimit, y.RateLimitRef, key)
+	if err != nil {
+		return
+	}
+	if limit == nil {
+		l.fail(node, key, ErrNoDefaultLimit)
+		return
+	}
+	d.Default = &Descriptor{Key: DefaultDescriptor, FullKey: key, Limit: limit, File: l.file}
+	if node != nil {
+		d.Default.Line = node.Line
+	}
+}
+
+// Limit is a limit given outside of the config files, like 100/second or 100/10s.
+type Limit struct {
+	limit *yamlRateLimit
+}
+
+// ParseLimit parses a limit like 100/second, or 100/10s for an interval, checked like the limits of the
+// config files.
+func ParseLimit(s string) (*Limit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidLimit
+	}
+	n, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, ErrInvalidLimit
+	}
+	limit := &yamlRateLimit{RequestsPerUnit: uint32(n), Unit: parts[1]}
+	if _, err = time.ParseDuration(parts[1]); err == nil {
+		limit = &yamlRateLimit{Requests: uint32(n), Interval: parts[1]}
+	}
+	if _, err = limit.ToRateLimit(""); err != nil {
+		return nil, err
+	}
+	return &Limit{limit: limit}, nil
+}
+
+// SetDefaultLimit sets the default limit of the domains which don't set their own.
+func (c *Config) SetDefaultLimit(limit *Limit) error {
+	for name, domain := range c.domains {
+		if domain.Default != nil {
+			continue
+		}
+		key := name + "." + DefaultDescriptor
+		rateLimit, err := limit.limit.toRateLimit(key, Metrics{})
 		if err != nil {
 			return err
 		}
-		d.Descriptors[descriptor.Key] = descriptor
+		d := &Descriptor{Key: DefaultDescriptor, FullKey: key, Limit: rateLimit}
+		d.setLimitOptions()
+		share, pods := c.topology.Share(name, domain.Zones)
+		if pods > 0 {
+			rateLimit.share(share, pods)
+		}
+		domain.Default = d
 	}
 	return nil
 }
 
-func (c *Config) loadConfig(config File) error {
+// Load a set of config descriptors from the YAML file and check the input.
+func (d *Descriptor) loadDescriptors(l *loader, descriptors []yamlDescriptor, nodes *yaml.Node) {
+	for i, conf := range descriptors {
+		descriptor := conf.ToDescriptor(l, d, item(nodes, i))
+		if descriptor != nil {
+			d.Descriptors[descriptor.Key] = descriptor
+		}
+	}
+}
+
+func (c *Config) loadConfig(config File, tables map[string][]byte) error {
+	l := &loader{file: config.Name, tables: tables, cache: c.tables}
+	var node yaml.Node
 	var root YamlFile
-	err := yaml.UnmarshalStrict(config.Content, &root)
+	decoder := yaml.NewDecoder(bytes.NewReader(config.Content))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&root)
+	if err == nil {
+		// the nodes locate the errors found after decoding.
+		err = yaml.Unmarshal(config.Content, &node)
+	}
+	if err == io.EOF {
+		err = ErrNoDomain
+	}
 	if err != nil {
-		return err
+		l.fail(nil, "", err)
+		return l.err()
+	}
+	doc := &node
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
 	}
 
 	if root.Domain == "" {
-		return ErrNoDomain
+		l.fail(doc, "", ErrNoDomain)
+		return l.err()
 	}
 
-	if _, present := c.domains[root.Domain]; present {
-		return ErrDuplicate
+	existing, present := c.domains[root.Domain]
+	if present && !(root.Merge && existing.Merge) {
+		l.fail(field(doc, "domain"), root.Domain, ErrDuplicate)
+		return l.err()
 	}
 
-	log.Debug().Msgf("loading domain: %s", root.Domain)
-	domain := &Domain{Descriptor{FullKey: root.Domain, Descriptors: map[string]*Descriptor{}}}
-	err = domain.loadDescriptors(root.Descriptors)
+	switch root.Backend {
+	case "":
+		root.Backend = BackendLocal
+	case BackendLocal, BackendRedis:
+	default:
+		l.fail(field(doc, "backend"), root.Domain, ErrInvalidBackend)
+	}
+
+	zones, err := root.Zones.ToZoneSplit()
 	if err != nil {
+		l.fail(field(doc, "zones"), root.Domain, err)
+	}
+
+	l.limits = root.Limits
+	for _, name := range sortedNames(root.Limits) {
+		if _, err := root.Limits[name].ToRateLimit(name); err != nil {
+			l.fail(field(field(doc, "limits"), name), "limits."+name, err)
+		}
+	}
+
+	log.Debug().Msgf("loading domain: %s", root.Domain)
+	domain := &Domain{Descriptor: Descriptor{FullKey: root.Domain, Descriptors: map[string]*Descriptor{}, File: config.Name, Line: doc.Line}, Backend: root.Backend, Zones: zones, File: config.Name, Merge: root.Merge}
+	domain.loadDescriptors(l, root.Descriptors, field(doc, "descriptors"))
+	domain.loadDefault(l, root.DefaultDescriptor, field(doc, "default_descriptor"))
+	if present {
+		if explicit := field(doc, "backend"); explicit != nil && domain.Backend != existing.Backend {
+			l.fail(explicit, root.Domain, &ConflictError{File: existing.File, Err: ErrInvalidBackend})
+		}
+		if zones != nil && existing.Zones != nil && !reflect.DeepEqual(zones, existing.Zones) {
+			l.fail(field(doc, "zones"), root.Domain, &ConflictError{File: existing.File, Err: ErrInvalidZoneSplit})
+		}
+		if domain.Default != nil && existing.Default != nil && !domain.Default.Limit.Equal(existing.Default.Limit) {
+			l.fail(field(doc, "default_descriptor"), domain.Default.FullKey,
+				&ConflictError{File: existing.Default.File, Line: existing.Default.Line, Err: ErrConflictingLimit})
+		}
+		existing.conflicts(l, &domain.Descriptor)
+	}
+	if err = l.err(); err != nil {
 		return err
 	}
+	if present {
+		if existing.Zones == nil {
+			existing.Zones = zones
+		}
+		if existing.Default == nil {
+			existing.Default = domain.Default
+		}
+		existing.merge(&domain.Descriptor)
+		return nil
+	}
 	c.domains[root.Domain] = domain
 	return nil
 }
 
-func (c *Config) KeyLimits() map[string]float64 {
-	m := map[string]float64{}
+// conflicts reports the descriptors of other defined with a different limit in d.
+func (d *Descriptor) conflicts(l *loader, other *Descriptor) {
+	for key, o := range other.Descriptors {
+		existing := d.Descriptors[key]
+		if existing == nil {
+			continue
+		}
+		if existing.Limit != nil && o.Limit != nil && !existing.Limit.Equal(o.Limit) ||
+			existing.Table != nil && o.Table != nil && existing.Table.Name != o.Table.Name {
+			l.errs = append(l.errs, &Error{File: o.File, Line: o.Line, Path: o.FullKey,
+				Err: &ConflictError{File: existing.File, Line: existing.Line, Err: ErrConflictingLimit}})
+		}
+		existing.conflicts(l, o)
+	}
+}
+
+// merge adds the descriptors of other to d, which must not conflict.
+func (d *Descriptor) merge(other *Descriptor) {
+	for key, o := range other.Descriptors {
+		existing := d.Descriptors[key]
+		if existing == nil {
+			d.Descriptors[key] = o
+			continue
+		}
+		if existing.Limit == nil {
+			existing.Limit = o.Limit
+		}
+		if existing.Table == nil {
+			existing.Table = o.Table
+		}
+		if existing.Schedules == nil {
+			existing.Schedules = o.Schedules
+		}
+		if existing.Allow == nil {
+			existing.Allow = o.Allow
+		}
+		if existing.Deny == nil {
+			existing.Deny = o.Deny
+		}
+		if existing.Penalty == nil {
+			existing.Penalty = o.Penalty
+		}
+		if existing.MaxWait == 0 {
+			existing.MaxWait = o.MaxWait
+		}
+		if existing.Cost == 0 {
+			existing.Cost = o.Cost
+		}
+		if existing.CostByValue == nil {
+			existing.CostByValue = o.CostByValue
+		}
+		existing.setLimitOptions()
+		existing.merge(o)
+	}
+}
+
+func (c *Config) KeyLimits() map[string]KeyLimit {
+	return c.KeyLimitsAt(time.Now())
+}
+
+// KeyLimitsAt returns the limits with the schedules active at t.
+func (c *Config) KeyLimitsAt(t time.Time) map[string]KeyLimit {
+	m := map[string]KeyLimit{}
 	for _, domain := range c.domains {
 		for _, descriptor := range domain.Descriptors {
-			descriptor.KeyLimits(m)
+			descriptor.KeyLimits(m, t)
+		}
+		if domain.Default != nil {
+			domain.Default.KeyLimits(m, t)
 		}
 	}
 	return m
 }
 
+func (c *Config) HasDomain(domain string) bool {
+	return c.domains[domain] != nil
+}
+
+// Domain returns the loaded domain, nil if unknown.
+func (c *Config) Domain(domain string) *Domain {
+	return c.domains[domain]
+}
+
+// Backends returns the backend keeping the counters per domain.
+func (c *Config) Backends() map[string]string {
+	m := make(map[string]string, len(c.domains))
+	for name, domain := range c.domains {
+		m[name] = domain.Backend
+	}
+	return m
+}
+
+// Backend returns the backend keeping the counters of domain.
+func (c *Config) Backend(domain string) string {
+	if d := c.domains[domain]; d != nil {
+		return d.Backend
+	}
+	return BackendLocal
+}
+
 func (c *Config) GetLimit(
 	_ context.Context, domain string, descriptor *pb_struct.RateLimitDescriptor) (rateLimit *RateLimit, err error) {
+	return c.getLimit(domain, descriptor, nil, time.Now())
+}
+
+// Explain matches descriptor like GetLimit, recording every step of the matching.
+func (c *Config) Explain(domain string, descriptor *pb_struct.RateLimitDescriptor) *Explanation {
+	return c.ExplainAt(domain, descriptor, time.Now())
+}
+
+// ExplainAt explains the match with the schedules active at t.
+func (c *Config) ExplainAt(domain string, descriptor *pb_struct.RateLimitDescriptor, t time.Time) *Explanation {
+	e := &Explanation{Domain: domain, At: t}
+	limit, err := c.getLimit(domain, descriptor, e, t)
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	if limit != nil && limit.Access == "" {
+		e.Limit = &ExplainedLimit{
+			FullKey:         limit.FullKey,
+			RequestsPerUnit: limit.RequestsPerUnit,
+			PerReplica:      limit.PerReplica,
+			Unit:            limit.Per(),
+			Cost:            limit.CostOf(descriptor),
+			Schedule:        e.activeSchedule,
+		}
+		for _, warning := range limit.warnings() {
+			e.Limit.Warnings = append(e.Limit.Warnings, warning.Error())
+		}
+	}
+	return e
+}
+
+func (c *Config) getLimit(domain string, descriptor *pb_struct.RateLimitDescriptor, e *Explanation, t time.Time) (rateLimit *RateLimit, err error) {
 	domainLimits := c.domains[domain]
 	if domainLimits == nil {
 		log.Debug().Msgf("unknown domain '%s'", domain)
+		e.fail("unknown domain")
 		return
 	}
+	if e != nil {
+		e.KnownDomain = true
+	}
 
 	if descriptor.GetLimit() != nil {
 		return nil, ErrUnsupportedRateLimitOverride
 	}
 
-	descriptors := domainLimits.Descriptors
+	if rateLimit = domainLimits.match(descriptor, e, t); rateLimit == nil && domainLimits.Default != nil {
+		var schedule *Schedule
+		rateLimit, schedule = domainLimits.Default.limitAt(t)
+		e.byDefault(schedule)
+	}
+	return
+}
+
+// match returns the limit of the descriptor matching all the entries, nil when there is none.
+func (d *Domain) match(descriptor *pb_struct.RateLimitDescriptor, e *Explanation, t time.Time) *RateLimit {
+	descriptors := d.Descriptors
 	for i, entry := range descriptor.Entries {
+		// the lists of the key only descriptor win over the key_value descriptors.
+		if keyOnly := descriptors[entry.Key]; keyOnly != nil {
+			if limit := keyOnly.listed(entry.Value); limit != nil {
+				e.step(entry, keyOnly, true)
+				e.listed(limit)
+				return limit
+			}
+		}
 		key := entry.Key + "_" + entry.Value
 		next := descriptors[key]
+		fallback := false
 		if next == nil {
 			key = entry.Key
 			next = descriptors[key]
+			fallback = true
+		}
+		last := i == len(descriptor.Entries)-1
+		if last && next != nil && next.Table != nil {
+			if limit := next.Table.limits[entry.Value]; limit != nil {
+				e.tableStep(entry, next.Table, limit)
+				return limit
+			}
 		}
+		e.step(entry, next, fallback)
 		if next == nil {
-			return
+			e.fail("no descriptor matches the entry")
+			return nil
 		}
-		if next.Limit != nil && i == len(descriptor.Entries)-1 {
-			log.Debug().Msgf("found rate limit: %s", key)
-			return next.Limit, nil
+		if last {
+			if limit, schedule := next.limitAt(t); limit != nil {
+				log.Debug().Msgf("found rate limit: %s", key)
+				e.schedule(schedule)
+				return limit
+			}
+			break
 		}
 		if len(next.Descriptors) == 0 {
-			return
+			e.fail("the matched descriptor has no children for the remaining entries")
+			return nil
 		}
 		descriptors = next.Descriptors
 	}
-	return
+	e.fail("the matched descriptor has no rate limit")
+	return nil
 }
 
 // New create rate limit config from a list of input YAML files.
-func New(replicas int32, configs []File) (*Config, error) {
-	c := &Config{domains: map[string]*Domain{}}
+func New(topology Topology, configs []File) (*Config, error) {
+	c, errs := Load(topology, configs, nil)
+	for _, err := range errs {
+		log.Error().Err(err).Msg("load config failed")
+	}
+	return c, nil
+}
+
+// Load creates the config like New, returning the errors of the files which were skipped. The value
+// tables are parsed once per content with a cache, every time without.
+func Load(topology Topology, configs []File, tables *TableCache) (*Config, []error) {
+	c := &Config{domains: map[string]*Domain{}, topology: topology, failed: map[string]bool{}, tables: tables}
+	var errs []error
+	tableFiles := map[string][]byte{}
 	for _, config := range configs {
-		err := c.loadConfig(config)
-		if err != nil {
-			log.Error().Err(err).Msgf("load config failed: %s", config.Name)
+		if IsTable(config.Name) {
+			tableFiles[config.Name] = config.Content
+		}
+	}
+	for _, config := range configs {
+		if IsTable(config.Name) {
 			continue
 		}
+		err := c.loadConfig(config, tableFiles)
+		if err != nil {
+			if domain := FileDomain(config.Content); domain != "" {
+				c.failed[domain] = true
+			}
+			if list, ok := err.(Errors); ok {
+				errs = append(errs, list...)
+			} else {
+				errs = append(errs, err)
+			}
+		}
 	}
-	if replicas == 1 || replicas == 0 {
-		return c, nil
+	divide(c, topology)
+	return c, errs
+}
+
+// FileDomain returns the domain of a config file, empty when it has none or can't be parsed.
+func FileDomain(content []byte) string {
+	var root struct {
+		Domain string
 	}
-	divideBy(c, uint32(replicas))
-	log.Info().Msgf("request unit is divide by replicas %d", replicas)
-	return c, nil
+	if yaml.Unmarshal(content, &root) != nil {
+		return ""
+	}
+	return root.Domain
+}
+
+// FailedDomains returns the domains of the files which failed to load, their tables included.
+func (c *Config) FailedDomains() map[string]bool {
+	m := make(map[string]bool, len(c.failed))
+	for domain := range c.failed {
+		m[domain] = true
+	}
+	return m
+}
+
+// Warnings returns the limits which the replicas enforce loosely.
+func (c *Config) Warnings() []error {
+	var errs []error
+	for _, domain := range c.domains {
+		domain.warnings(domain.File, &errs)
+		if domain.Default != nil {
+			domain.Default.warnings(domain.File, &errs)
+		}
+	}
+	return errs
 }
 
-func divideBy(c *Config, replicas uint32) {
-	for _, rc := range c.domains {
-		divideRPBy(&rc.Descriptor, replicas)
+func (d *Descriptor) warnings(file string, errs *[]error) {
+	if d.Limit != nil {
+		for _, err := range d.Limit.warnings() {
+			*errs = append(*errs, &Error{File: file, Path: d.FullKey, Err: err})
+		}
+	}
+	for _, s := range d.Schedules {
+		for _, err := range s.Limit.warnings() {
+			*errs = append(*errs, &Error{File: file, Path: d.FullKey + " schedule " + s.Name, Err: err})
+		}
+	}
+	if d.Table != nil {
+		for _, limit := range d.Table.limits {
+			for _, err := range limit.warnings() {
+				*errs = append(*errs, &Error{File: d.Table.Name, Path: limit.FullKey, Err: err})
+			}
+		}
+	}
+	for _, child := range d.Descriptors {
+		child.warnings(file, errs)
 	}
 }
 
-func divideRPBy(r *Descriptor, replicas uint32) {
+func divide(c *Config, topology Topology) {
+	for name, rc := range c.domains {
+		share, pods := topology.Share(name, rc.Zones)
+		if share == 1 && (pods == 1 || pods == 0) {
+			continue
+		}
+		divideRPByShare(&rc.Descriptor, share, pods)
+		if rc.Default != nil {
+			divideRPByShare(rc.Default, share, pods)
+		}
+		if share == 1 {
+			log.Info().Msgf("request unit of %s is divide by replicas %d", name, pods)
+			continue
+		}
+		log.Info().Msgf("request unit of %s is divide by %d replicas of zone %s with share %.3f", name, pods, topology.Zone, share)
+	}
+}
+
+func divideRPByShare(r *Descriptor, share float64, pods int32) {
 	if r.Limit != nil {
-		r.Limit.Limit.RequestsPerUnit /= replicas
+		r.Limit.share(share, pods)
+	}
+	for _, s := range r.Schedules {
+		s.Limit.share(share, pods)
+	}
+	if r.Table != nil {
+		for _, limit := range r.Table.limits {
+			limit.share(share, pods)
+		}
 	}
 	for _, des := range r.Descriptors {
-		divideRPBy(des, replicas)
+		divideRPByShare(des, share, pods)
 	}
 }
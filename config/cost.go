@@ -0,0 +1,58 @@
+package config
+
+import (
+	"errors"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"math"
+)
+
+var ErrInvalidCost = errors.New("cost_by_value must be positive")
+
+// CostOf returns the tokens a hit of the descriptor consumes, by the value of its last entry, which the limit
+// was matched with.
+func (l *RateLimit) CostOf(descriptor *pb_struct.RateLimitDescriptor) uint32 {
+	if n := len(descriptor.GetEntries()); n > 0 && l.CostByValue != nil {
+		if cost, ok := l.CostByValue[descriptor.Entries[n-1].Value]; ok {
+			return cost
+		}
+	}
+	if l.Cost > 0 {
+		return l.Cost
+	}
+	return 1
+}
+
+// maxCost returns the tokens the costliest hit consumes.
+func (l *RateLimit) maxCost() uint32 {
+	max := uint32(1)
+	if l.Cost > max {
+		max = l.Cost
+	}
+	for _, cost := range l.CostByValue {
+		if cost > max {
+			max = cost
+		}
+	}
+	return max
+}
+
+// Consumption returns the tokens the hits of the descriptor consume, saturated at math.MaxUint32.
+func (l *RateLimit) Consumption(descriptor *pb_struct.RateLimitDescriptor, hitsAddend uint32) uint32 {
+	if hitsAddend == 0 {
+		hitsAddend = 1
+	}
+	n := uint64(l.CostOf(descriptor)) * uint64(hitsAddend)
+	if n > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(n)
+}
+
+func checkCostByValue(costs map[string]uint32) error {
+	for _, cost := range costs {
+		if cost == 0 {
+			return ErrInvalidCost
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+)
+
+// Error locates an error in a config file.
+type Error struct {
+	File string
+	Line int
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		b.WriteString(":" + strconv.Itoa(e.Line))
+	}
+	if e.Path != "" {
+		b.WriteString(": " + e.Path)
+	}
+	b.WriteString(": " + e.Err.Error())
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError points to the definition another one conflicts with.
+type ConflictError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *ConflictError) Error() string {
+	location := e.File
+	if e.Line > 0 {
+		location += ":" + strconv.Itoa(e.Line)
+	}
+	return e.Err.Error() + " at " + location
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Errors are all the errors found in a config file.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// loader collects the errors of a file instead of stopping at the first one.
+type loader struct {
+	file string
+	errs Errors
+	// limits are the named profiles of the file, rate_limit_ref resolves to them.
+	limits map[string]*yamlRateLimit
+	// tables are the contents of the table files of the config source.
+	tables map[string][]byte
+	cache  *TableCache
+}
+
+func (l *loader) fail(node *yaml.Node, path string, err error) {
+	e := &Error{File: l.file, Path: path, Err: err}
+	if node != nil {
+		e.Line = node.Line
+	}
+	l.errs = append(l.errs, e)
+}
+
+func (l *loader) err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return l.errs
+}
+
+// field returns the value node of key in a mapping node.
+func field(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// item returns the i-th node of a sequence node.
+func item(node *yaml.Node, i int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+		return nil
+	}
+	return node.Content[i]
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"time"
+)
+
+// Explanation is the path a descriptor takes through the config.
+type Explanation struct {
+	Domain      string          `json:"domain"`
+	KnownDomain bool            `json:"known_domain"`
+	Steps       []Step          `json:"steps"`
+	Limit       *ExplainedLimit `json:"limit,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	// Access is set when an allow or deny list decides the status.
+	Access Access `json:"access,omitempty"`
+	// Default is set when no descriptor matched and the default descriptor of the domain applies.
+	Default bool `json:"default,omitempty"`
+	// At is the time the schedules are evaluated at.
+	At time.Time `json:"at"`
+
+	activeSchedule string
+}
+
+// Step is the match of one descriptor entry.
+type Step struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Matched is the full key of the matched descriptor.
+	Matched string `json:"matched,omitempty"`
+	// Fallback is set when key_value did not match and key only was tried.
+	Fallback bool `json:"fallback"`
+	// Table is the value table the value was found in.
+	Table string `json:"table,omitempty"`
+}
+
+type ExplainedLimit struct {
+	FullKey         string  `json:"full_key"`
+	RequestsPerUnit uint32  `json:"requests_per_unit"`
+	PerReplica      float64 `json:"per_replica"`
+	Unit            string  `json:"unit"`
+	// Cost is the tokens a hit of the descriptor consumes.
+	Cost uint32 `json:"cost"`
+	// Schedule is the active schedule replacing the limit of the descriptor.
+	Schedule string `json:"schedule,omitempty"`
+	// Warnings tell why the replicas enforce the limit loosely.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (e *Explanation) step(entry *pb_struct.RateLimitDescriptor_Entry, matched *Descriptor, fallback bool) {
+	if e == nil {
+		return
+	}
+	step := Step{Key: entry.Key, Value: entry.Value, Fallback: fallback}
+	if matched != nil {
+		step.Matched = matched.FullKey
+	}
+	e.Steps = append(e.Steps, step)
+}
+
+func (e *Explanation) tableStep(entry *pb_struct.RateLimitDescriptor_Entry, table *Table, limit *RateLimit) {
+	if e == nil {
+		return
+	}
+	e.Steps = append(e.Steps, Step{Key: entry.Key, Value: entry.Value, Matched: limit.FullKey, Fallback: true, Table: table.Name})
+}
+
+func (e *Explanation) schedule(s *Schedule) {
+	if e == nil || s == nil {
+		return
+	}
+	e.activeSchedule = s.Name
+}
+
+func (e *Explanation) listed(limit *RateLimit) {
+	if e == nil {
+		return
+	}
+	e.Access = limit.Access
+	e.Reason = "the value is in the " + string(limit.Access) + " list of " + limit.FullKey
+}
+
+func (e *Explanation) byDefault(s *Schedule) {
+	if e == nil {
+		return
+	}
+	e.Default = true
+	e.schedule(s)
+}
+
+func (e *Explanation) fail(reason string) {
+	if e == nil {
+		return
+	}
+	e.Reason = reason
+}
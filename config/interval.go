@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"math"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidInterval = errors.New("interval must be a duration of at least 1s, without requests_per_unit and unit")
+
+var unitIntervals = map[pb.RateLimitResponse_RateLimit_Unit]time.Duration{
+	pb.RateLimitResponse_RateLimit_SECOND: time.Second,
+	pb.RateLimitResponse_RateLimit_MINUTE: time.Minute,
+	pb.RateLimitResponse_RateLimit_HOUR:   time.Hour,
+	pb.RateLimitResponse_RateLimit_DAY:    24 * time.Hour,
+}
+
+// intervalUnit returns the unit lasting interval, UNKNOWN when there is none.
+func intervalUnit(interval time.Duration) pb.RateLimitResponse_RateLimit_Unit {
+	for unit, d := range unitIntervals {
+		if d == interval {
+			return unit
+		}
+	}
+	return pb.RateLimitResponse_RateLimit_UNKNOWN
+}
+
+// newIntervalLimit creates a limit of requests per interval.
+func newIntervalLimit(requests uint32, interval time.Duration, key string, metrics Metrics) *RateLimit {
+	return &RateLimit{FullKey: key, Metrics: metrics, RequestsPerUnit: requests, Interval: interval, PerReplica: float64(requests),
+		Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: requests, Unit: intervalUnit(interval)}}
+}
+
+// Per names the interval of the limit, the unit when it lasts one.
+func (l *RateLimit) Per() string {
+	if l.Limit.Unit != pb.RateLimitResponse_RateLimit_UNKNOWN {
+		return l.Limit.Unit.String()
+	}
+	return l.Interval.String()
+}
+
+// share sets the part of the limit of this replica.
+func (l *RateLimit) share(share float64, pods int32) {
+	l.PerReplica = float64(l.RequestsPerUnit) * share / float64(pods)
+}
+
+// warnings returns why the replicas enforce the limit loosely: a share below a request is rounded up to a
+// whole request, and a cost above the share raises the burst, so the replicas together admit more than the
+// limit at first.
+func (l *RateLimit) warnings() []error {
+	var errs []error
+	if l.RequestsPerUnit > 0 && l.PerReplica < 1 {
+		errs = append(errs, ErrFractionalShare)
+	}
+	if int(l.maxCost()) > l.shareBurst() {
+		errs = append(errs, ErrCostOverBurst)
+	}
+	return errs
+}
+
+// KeyLimit is the token bucket of a limit on this replica.
+type KeyLimit struct {
+	// Rate is in tokens per second.
+	Rate  float64
+	Burst int
+}
+
+// shareBurst is the part of the replica rounded up to whole requests.
+func (l *RateLimit) shareBurst() int {
+	return int(math.Ceil(l.PerReplica))
+}
+
+// keyLimit refills the part of the replica over the interval, a fraction of a request allows one and the
+// burst fits at least the costliest hit, which could never be admitted otherwise.
+func (l *RateLimit) keyLimit() KeyLimit {
+	burst := l.shareBurst()
+	if cost := int(l.maxCost()); cost > burst {
+		burst = cost
+	}
+	return KeyLimit{Rate: l.PerReplica / l.Interval.Seconds(), Burst: burst}
+}
+
+func (k KeyLimit) String() string {
+	return strconv.FormatFloat(k.Rate, 'g', 4, 64) + "/s burst " + strconv.Itoa(k.Burst)
+}
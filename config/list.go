@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	ErrEmptyListEntry = errors.New("allow and deny entries must not be empty")
+	ErrListWithValue  = errors.New("a descriptor with allow or deny must not set a value")
+)
+
+// Access is the verdict of the allow and deny lists on a limit, empty when the limit is checked.
+type Access string
+
+const (
+	// AccessAllow answers OK without counting the hit.
+	AccessAllow Access = "allow"
+	// AccessDeny answers OVER_LIMIT.
+	AccessDeny Access = "deny"
+)
+
+// List matches the values of the entry of a descriptor exactly, by prefix when the entry ends with *,
+// or by CIDR.
+type List struct {
+	exact    map[string]struct{}
+	prefixes []string
+	nets     []*net.IPNet
+	// limit is returned for the values the list contains.
+	limit *RateLimit
+}
+
+func newList(entries []string, fullKey string, access Access) (*List, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	l := &List{exact: map[string]struct{}{}, limit: &RateLimit{FullKey: fullKey, Access: access}}
+	for _, entry := range entries {
+		if entry == "" {
+			return nil, ErrEmptyListEntry
+		}
+		if strings.HasSuffix(entry, "*") {
+			l.prefixes = append(l.prefixes, strings.TrimSuffix(entry, "*"))
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			l.nets = append(l.nets, ipNet)
+			continue
+		}
+		l.exact[entry] = struct{}{}
+	}
+	return l, nil
+}
+
+// Contains reports whether the list matches value.
+func (l *List) Contains(value string) bool {
+	if l == nil {
+		return false
+	}
+	if _, ok := l.exact[value]; ok {
+		return true
+	}
+	for _, prefix := range l.prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	if len(l.nets) > 0 {
+		if ip := net.ParseIP(value); ip != nil {
+			for _, ipNet := range l.nets {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// listed returns the limit deciding the value of the entry of d, the deny list first, nil when no list
+// contains the value.
+func (d *Descriptor) listed(value string) *RateLimit {
+	if d.Deny.Contains(value) {
+		return d.Deny.limit
+	}
+	if d.Allow.Contains(value) {
+		return d.Allow.limit
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrUnknownDescriptor = errors.New("no descriptor with this path")
+
+// OverrideSchedule is the name an override is listed with among the active schedules.
+const OverrideSchedule = "override"
+
+// Override replaces the limit of a descriptor until it expires. Path is the full key of the descriptor
+// without the domain, like plan_premium.user. The limit is given like in the config, with
+// requests_per_unit and unit or with requests and interval.
+type Override struct {
+	Domain          string    `json:"domain"`
+	Path            string    `json:"path"`
+	RequestsPerUnit uint32    `json:"requests_per_unit,omitempty"`
+	Unit            string    `json:"unit,omitempty"`
+	Requests        uint32    `json:"requests,omitempty"`
+	Interval        string    `json:"interval,omitempty"`
+	Expires         time.Time `json:"expires"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+func (o *Override) FullKey() string {
+	return o.Domain + "." + o.Path
+}
+
+// Limit returns the limit of the override like 100/second or 100/10s.
+func (o *Override) Limit() string {
+	if o.Interval != "" || o.Requests > 0 {
+		return fmt.Sprintf("%d/%s", o.Requests, o.Interval)
+	}
+	return fmt.Sprintf("%d/%s", o.RequestsPerUnit, o.Unit)
+}
+
+// Expired reports whether the override no longer applies at t.
+func (o *Override) Expired(t time.Time) bool {
+	return !t.Before(o.Expires)
+}
+
+type override struct {
+	// schedule lists the override among the active schedules.
+	schedule *Schedule
+	expires  time.Time
+}
+
+// ApplyOverrides sets the overrides on the descriptors they refer to, dividing their limits like the
+// config. The overrides which don't apply are returned as errors.
+func (c *Config) ApplyOverrides(overrides []Override) []error {
+	var errs []error
+	now := time.Now()
+	for i := range overrides {
+		o := &overrides[i]
+		if o.Expired(now) {
+			continue
+		}
+		d, limit, err := c.resolve(o)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		d.setOptions(limit)
+		domain := c.domains[o.Domain]
+		share, pods := c.topology.Share(o.Domain, domain.Zones)
+		if pods > 0 {
+			limit.share(share, pods)
+		}
+		d.override = &override{schedule: &Schedule{Name: OverrideSchedule, Limit: limit}, expires: o.Expires}
+	}
+	return errs
+}
+
+// CheckOverride reports whether the override applies to this config.
+func (c *Config) CheckOverride(o *Override) error {
+	_, _, err := c.resolve(o)
+	return err
+}
+
+func (c *Config) resolve(o *Override) (*Descriptor, *RateLimit, error) {
+	domain := c.domains[o.Domain]
+	if domain == nil {
+		return nil, nil, fmt.Errorf("override %s: %w", o.FullKey(), ErrUnknownDescriptor)
+	}
+	d := domain.find(o.FullKey())
+	if d == nil && domain.Default != nil && domain.Default.FullKey == o.FullKey() {
+		d = domain.Default
+	}
+	if d == nil {
+		return nil, nil, fmt.Errorf("override %s: %w", o.FullKey(), ErrUnknownDescriptor)
+	}
+	y := &yamlRateLimit{RequestsPerUnit: o.RequestsPerUnit, Unit: o.Unit, Requests: o.Requests, Interval: o.Interval}
+	limit, err := y.ToRateLimit(d.FullKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("override %s: %w", o.FullKey(), err)
+	}
+	return d, limit, nil
+}
+
+// find returns the descriptor with the full key, nil when there is none.
+func (d *Descriptor) find(fullKey string) *Descriptor {
+	if d.FullKey == fullKey {
+		return d
+	}
+	for _, child := range d.Descriptors {
+		if strings.HasPrefix(fullKey, child.FullKey) {
+			if found := child.find(fullKey); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidPenalty = errors.New("invalid penalty")
+
+// Penalty bans the values of a descriptor which go over its limit more than Violations times within
+// Window. A ban lasts Ban, doubled by every ban following the previous one within MaxBan, up to MaxBan.
+type Penalty struct {
+	Violations int
+	Window     time.Duration
+	Ban        time.Duration
+	MaxBan     time.Duration
+}
+
+// BanFor returns the duration of the ban after bans previous ones.
+func (p *Penalty) BanFor(bans int) time.Duration {
+	d := p.Ban
+	for i := 0; i < bans && d < p.MaxBan; i++ {
+		d *= 2
+	}
+	if d > p.MaxBan {
+		d = p.MaxBan
+	}
+	return d
+}
+
+type yamlPenalty struct {
+	// Violations is the number of over limit answers a value may get within the window before its ban.
+	Violations int
+	Window     string
+	Ban        string
+	// MaxBan caps the escalating bans, the bans don't escalate without it.
+	MaxBan string `yaml:"max_ban"`
+}
+
+func invalidPenalty(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPenalty, fmt.Sprintf(format, args...))
+}
+
+func (y *yamlPenalty) ToPenalty() (*Penalty, error) {
+	if y == nil {
+		return nil, nil
+	}
+	if y.Violations <= 0 {
+		return nil, invalidPenalty("violations must be positive")
+	}
+	p := &Penalty{Violations: y.Violations}
+	var err error
+	if p.Window, err = time.ParseDuration(y.Window); err != nil || p.Window <= 0 {
+		return nil, invalidPenalty("window %q must be a positive duration", y.Window)
+	}
+	if p.Ban, err = time.ParseDuration(y.Ban); err != nil || p.Ban <= 0 {
+		return nil, invalidPenalty("ban %q must be a positive duration", y.Ban)
+	}
+	p.MaxBan = p.Ban
+	if y.MaxBan != "" {
+		if p.MaxBan, err = time.ParseDuration(y.MaxBan); err != nil || p.MaxBan < p.Ban {
+			return nil, invalidPenalty("max_ban %q must be a duration of at least the ban", y.MaxBan)
+		}
+	}
+	return p, nil
+}
+
+// setOptions sets the penalty, max wait and costs of d on one of its limits.
+func (d *Descriptor) setOptions(limit *RateLimit) {
+	limit.Penalty = d.Penalty
+	limit.MaxWait = d.MaxWait
+	limit.Cost = d.Cost
+	limit.CostByValue = d.CostByValue
+}
+
+// setLimitOptions sets the penalty, max wait and costs of d on all its limits, the overrides get them when
+// applied.
+func (d *Descriptor) setLimitOptions() {
+	if d.Limit != nil {
+		d.setOptions(d.Limit)
+	}
+	for _, s := range d.Schedules {
+		d.setOptions(s.Limit)
+	}
+	if d.Table != nil {
+		for _, limit := range d.Table.limits {
+			d.setOptions(limit)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Schedule replaces the limit of a descriptor while it is active. The limit keeps the full key of the
+// descriptor, so switching keeps the state of its bucket.
+type Schedule struct {
+	Name  string
+	Limit *RateLimit
+
+	location *time.Location
+	days     []bool
+	// start and end are minutes of the day, both -1 without hours.
+	start, end int
+	from, to   time.Time
+}
+
+// Active reports whether the schedule applies at t.
+func (s *Schedule) Active(t time.Time) bool {
+	if !s.from.IsZero() && t.Before(s.from) {
+		return false
+	}
+	if !s.to.IsZero() && !t.Before(s.to) {
+		return false
+	}
+	t = t.In(s.location)
+	if s.days != nil && !s.days[t.Weekday()] {
+		return false
+	}
+	if s.start < 0 {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	if s.start <= s.end {
+		return m >= s.start && m < s.end
+	}
+	// the range wraps midnight.
+	return m >= s.start || m < s.end
+}
+
+type yamlSchedule struct {
+	Name string
+	// Hours is a daily range like 01:00-05:00, the end is excluded.
+	Hours string
+	// Days are the weekdays the schedule applies, mon to sun.
+	Days []string
+	// From and To are RFC 3339 times bounding the schedule.
+	From         string
+	To           string
+	Timezone     string
+	RateLimit    *yamlRateLimit `yaml:"rate_limit"`
+	RateLimitRef string         `yaml:"rate_limit_ref"`
+}
+
+func invalidSchedule(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidSchedule, fmt.Sprintf(format, args...))
+}
+
+func parseMinute(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ToSchedule parses the rules of the schedule, limit is its resolved rate limit.
+func (y *yamlSchedule) ToSchedule(limit *RateLimit) (*Schedule, error) {
+	s := &Schedule{Name: y.Name, Limit: limit, location: time.UTC, start: -1, end: -1}
+	if y.Name == "" {
+		return nil, invalidSchedule("name is required")
+	}
+	if y.Hours == "" && len(y.Days) == 0 && y.From == "" && y.To == "" {
+		return nil, invalidSchedule("%s sets none of hours, days, from and to", y.Name)
+	}
+	if y.Timezone != "" {
+		location, err := time.LoadLocation(y.Timezone)
+		if err != nil {
+			return nil, invalidSchedule("%s: %s", y.Name, err)
+		}
+		s.location = location
+	}
+	if y.Hours != "" {
+		bounds := strings.SplitN(y.Hours, "-", 2)
+		if len(bounds) != 2 {
+			return nil, invalidSchedule("%s: hours must be HH:MM-HH:MM", y.Name)
+		}
+		var err error
+		if s.start, err = parseMinute(bounds[0]); err != nil {
+			return nil, invalidSchedule("%s: hours must be HH:MM-HH:MM", y.Name)
+		}
+		if s.end, err = parseMinute(bounds[1]); err != nil {
+			return nil, invalidSchedule("%s: hours must be HH:MM-HH:MM", y.Name)
+		}
+	}
+	if len(y.Days) > 0 {
+		s.days = make([]bool, 7)
+		for _, day := range y.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, invalidSchedule("%s: unknown day %s", y.Name, day)
+			}
+			s.days[weekday] = true
+		}
+	}
+	var err error
+	if y.From != "" {
+		if s.from, err = time.Parse(time.RFC3339, y.From); err != nil {
+			return nil, invalidSchedule("%s: %s", y.Name, err)
+		}
+	}
+	if y.To != "" {
+		if s.to, err = time.Parse(time.RFC3339, y.To); err != nil {
+			return nil, invalidSchedule("%s: %s", y.Name, err)
+		}
+	}
+	return s, nil
+}
+
+// limitAt returns the limit of an unexpired override, of the first active schedule, or the limit of
+// the descriptor otherwise.
+func (d *Descriptor) limitAt(t time.Time) (*RateLimit, *Schedule) {
+	if d.override != nil && t.Before(d.override.expires) {
+		return d.override.schedule.Limit, d.override.schedule
+	}
+	for _, s := range d.Schedules {
+		if s.Active(t) {
+			return s.Limit, s
+		}
+	}
+	return d.Limit, nil
+}
+
+// ActiveSchedules returns the name of the active schedule per full key of the descriptors with schedules,
+// the default descriptors included.
+func (c *Config) ActiveSchedules(t time.Time) map[string]string {
+	m := map[string]string{}
+	for _, domain := range c.domains {
+		domain.activeSchedules(t, m)
+		if domain.Default != nil {
+			domain.Default.activeSchedules(t, m)
+		}
+	}
+	return m
+}
+
+func (d *Descriptor) activeSchedules(t time.Time, m map[string]string) {
+	if _, s := d.limitAt(t); s != nil {
+		m[d.FullKey] = s.Name
+	}
+	for _, child := range d.Descriptors {
+		child.activeSchedules(t, m)
+	}
+}
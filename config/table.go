@@ -0,0 +1,292 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownTable   = errors.New("unknown value table")
+	ErrTableWithValue = errors.New("a descriptor with a table must not set a value")
+	ErrInvalidRow     = errors.New("row must be value,profile or value,requests_per_unit,unit")
+)
+
+// IsTable reports whether the file is a value table rather than a yaml config.
+func IsTable(name string) bool {
+	switch path.Ext(name) {
+	case ".csv", ".json":
+		return true
+	}
+	return false
+}
+
+// Table maps the values of a key only descriptor to their own limits, for sets of values too large to
+// be written as descriptors.
+type Table struct {
+	Name   string
+	limits map[string]*RateLimit
+	hash   [sha256.Size]byte
+	// profiles are the named limits of the file of the descriptor, the rows may refer to them.
+	profiles map[string]*yamlRateLimit
+}
+
+func (t *Table) Len() int {
+	return len(t.limits)
+}
+
+type tableRow struct {
+	line    int
+	profile string
+	limit   *yamlRateLimit
+}
+
+type parsedTable struct {
+	hash [sha256.Size]byte
+	rows map[string]tableRow
+	errs []error
+}
+
+// TableCache keeps the parsed tables so a table is parsed again only when its content changes. The tables
+// are kept per content, a config and its last known good one may use different contents of a table.
+type TableCache struct {
+	mu     sync.Mutex
+	tables map[tableKey]*parsedTable
+}
+
+type tableKey struct {
+	name string
+	hash [sha256.Size]byte
+}
+
+func NewTableCache() *TableCache {
+	return &TableCache{tables: map[tableKey]*parsedTable{}}
+}
+
+// get returns the parsed table, a nil cache parses it every time.
+func (c *TableCache) get(name string, content []byte) *parsedTable {
+	key := tableKey{name: name, hash: sha256.Sum256(content)}
+	if c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if t := c.tables[key]; t != nil {
+			return t
+		}
+	}
+	t := &parsedTable{hash: key.hash}
+	var err error
+	if path.Ext(name) == ".json" {
+		t.rows, err = parseJSONTable(content)
+	} else {
+		t.rows, t.errs = parseCSVTable(name, content)
+	}
+	if err != nil {
+		t.errs = append(t.errs, &Error{File: name, Err: err})
+	}
+	if c != nil {
+		c.tables[key] = t
+	}
+	return t
+}
+
+// Prune forgets the tables whose content is in none of the sets of files.
+func (c *TableCache) Prune(files ...map[string][]byte) {
+	keep := map[tableKey]bool{}
+	for _, contents := range files {
+		for name, content := range contents {
+			if IsTable(name) {
+				keep[tableKey{name: name, hash: sha256.Sum256(content)}] = true
+			}
+		}
+	}
+	c.mu.Lock()
+	for key := range c.tables {
+		if !keep[key] {
+			delete(c.tables, key)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// parseCSVTable reads rows of value,profile, value,requests_per_unit,unit or value,requests,interval, lines
+// starting with # are comments.
+func parseCSVTable(name string, content []byte) (map[string]tableRow, []error) {
+	rows := map[string]tableRow{}
+	var errs []error
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		record := strings.Split(text, ",")
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		row := tableRow{line: line}
+		switch len(record) {
+		case 2:
+			row.profile = record[1]
+		case 3:
+			n, err := strconv.ParseUint(record[1], 10, 32)
+			if err != nil {
+				errs = append(errs, &Error{File: name, Line: line, Path: record[0], Err: ErrInvalidRow})
+				continue
+			}
+			row.limit = &yamlRateLimit{RequestsPerUnit: uint32(n), Unit: record[2]}
+			if _, err := time.ParseDuration(record[2]); err == nil {
+				row.limit = &yamlRateLimit{Requests: uint32(n), Interval: record[2]}
+			}
+		default:
+			errs = append(errs, &Error{File: name, Line: line, Err: ErrInvalidRow})
+			continue
+		}
+		if _, ok := rows[record[0]]; ok {
+			errs = append(errs, &Error{File: name, Line: line, Path: record[0], Err: ErrDuplicateDescriptor})
+			continue
+		}
+		rows[record[0]] = row
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, &Error{File: name, Line: line, Err: err})
+	}
+	return rows, errs
+}
+
+// parseJSONTable reads an object of value to a profile name or to a {"requests_per_unit", "unit"} or a
+// {"requests", "interval"} limit.
+func parseJSONTable(content []byte) (map[string]tableRow, error) {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+	rows := make(map[string]tableRow, len(raw))
+	for value, message := range raw {
+		var row tableRow
+		if strings.HasPrefix(strings.TrimSpace(string(message)), `"`) {
+			if err := json.Unmarshal(message, &row.profile); err != nil {
+				return nil, fmt.Errorf("%s: %w", value, err)
+			}
+		} else {
+			var limit struct {
+				RequestsPerUnit uint32 `json:"requests_per_unit"`
+				Unit            string `json:"unit"`
+				Requests        uint32 `json:"requests"`
+				Interval        string `json:"interval"`
+			}
+			if err := json.Unmarshal(message, &limit); err != nil {
+				return nil, fmt.Errorf("%s: %w", value, err)
+			}
+			row.limit = &yamlRateLimit{RequestsPerUnit: limit.RequestsPerUnit, Unit: limit.Unit, Requests: limit.Requests, Interval: limit.Interval}
+		}
+		rows[value] = row
+	}
+	return rows, nil
+}
+
+// tableName resolves the table referenced by a config file relative to its directory.
+func tableName(file, table string) string {
+	return path.Join(path.Dir(file), table)
+}
+
+// table builds the limits of the table referenced by the descriptor d.
+func (l *loader) table(d *Descriptor, name string) *Table {
+	name = tableName(l.file, name)
+	content, ok := l.tables[name]
+	if !ok {
+		l.errs = append(l.errs, &Error{File: l.file, Line: d.Line, Path: d.FullKey, Err: fmt.Errorf("%w: %s", ErrUnknownTable, name)})
+		return nil
+	}
+	t, errs := buildTable(l.cache, d, name, content, l.limits)
+	l.errs = append(l.errs, errs...)
+	return t
+}
+
+// buildTable builds the limits of a table of the descriptor d. The rows share the metrics of d, their
+// buckets are keyed as if they were key_value descriptors.
+func buildTable(cache *TableCache, d *Descriptor, name string, content []byte, profiles map[string]*yamlRateLimit) (*Table, []error) {
+	parsed := cache.get(name, content)
+	if len(parsed.errs) > 0 {
+		return nil, parsed.errs
+	}
+	var errs []error
+	metrics := NewMetrics(d.FullKey)
+	t := &Table{Name: name, limits: make(map[string]*RateLimit, len(parsed.rows)), hash: parsed.hash, profiles: profiles}
+	for value, row := range parsed.rows {
+		limit := row.limit
+		if row.profile != "" {
+			limit = profiles[row.profile]
+			if limit == nil {
+				errs = append(errs, &Error{File: name, Line: row.line, Path: value, Err: fmt.Errorf("%w: %s", ErrUnknownLimitRef, row.profile)})
+				continue
+			}
+		}
+		rateLimit, err := limit.toRateLimit(d.FullKey+"_"+value, metrics)
+		if err != nil {
+			errs = append(errs, &Error{File: name, Line: row.line, Path: value, Err: err})
+			continue
+		}
+		t.limits[value] = rateLimit
+	}
+	return t, errs
+}
+
+// WithTables returns a copy of the config with new contents of its value tables, its yaml files being the
+// same. Only the tables whose content changed are built again, the other limits are shared with c.
+func (c *Config) WithTables(contents map[string][]byte) (*Config, []error) {
+	n := &Config{domains: make(map[string]*Domain, len(c.domains)), topology: c.topology, failed: map[string]bool{}, tables: c.tables}
+	var errs []error
+	for name, domain := range c.domains {
+		share, pods := c.topology.Share(name, domain.Zones)
+		copied := *domain
+		copied.Descriptor = *domain.Descriptor.withTables(c.tables, contents, share, pods, &errs)
+		if domain.Default != nil {
+			copied.Default = domain.Default.withTables(c.tables, contents, share, pods, &errs)
+		}
+		n.domains[name] = &copied
+	}
+	return n, errs
+}
+
+// withTables copies the descriptor tree without the overrides, building the changed tables again.
+func (d *Descriptor) withTables(cache *TableCache, contents map[string][]byte, share float64, pods int32, errs *[]error) *Descriptor {
+	copied := *d
+	copied.override = nil
+	if d.Table != nil {
+		content, ok := contents[d.Table.Name]
+		switch {
+		case !ok:
+			*errs = append(*errs, &Error{File: d.File, Line: d.Line, Path: d.FullKey, Err: fmt.Errorf("%w: %s", ErrUnknownTable, d.Table.Name)})
+		case sha256.Sum256(content) != d.Table.hash:
+			t, tableErrs := buildTable(cache, d, d.Table.Name, content, d.Table.profiles)
+			*errs = append(*errs, tableErrs...)
+			if t != nil {
+				for _, limit := range t.limits {
+					d.setOptions(limit)
+					if pods > 0 {
+						limit.share(share, pods)
+					}
+				}
+				copied.Table = t
+			}
+		}
+	}
+	if d.Descriptors != nil {
+		copied.Descriptors = make(map[string]*Descriptor, len(d.Descriptors))
+		for key, child := range d.Descriptors {
+			copied.Descriptors[key] = child.withTables(cache, contents, share, pods, errs)
+		}
+	}
+	return &copied
+}
@@ -0,0 +1,81 @@
+package config
+
+const (
+	ZoneSplitWeight = "weight"
+	ZoneSplitDemand = "demand"
+)
+
+// minZoneShare is the part of its pods' even share a zone keeps whatever its weight or demand,
+// so a zone taking traffic it had no demand for is not starved until the demand catches up.
+const minZoneShare = 0.1
+
+// ZoneSplit splits the limits of a domain among the zones before dividing them among the pods of a zone.
+type ZoneSplit struct {
+	Split string
+	// Weights of the zones for the weight split, zones not listed weigh 1.
+	Weights map[string]float64
+}
+
+// Topology of the replicas the limits are divided among.
+type Topology struct {
+	Replicas int32
+	// Zone of this replica.
+	Zone string
+	// Zones is the number of ready replicas per zone.
+	Zones map[string]int32
+	// Demand is the observed share of the hits per domain and zone.
+	Demand map[string]map[string]float64
+}
+
+func (t Topology) weight(domain string, split *ZoneSplit, zone string) float64 {
+	switch split.Split {
+	case ZoneSplitWeight:
+		if weight, ok := split.Weights[zone]; ok {
+			return weight
+		}
+		return 1
+	case ZoneSplitDemand:
+		return t.Demand[domain][zone]
+	}
+	return 0
+}
+
+// Share returns the share of the limits of domain given to the zone of this replica,
+// and the number of replicas in the zone to divide it by.
+// The replicas of unknown zones keep their even share of the limits out of the split of the zones.
+func (t Topology) Share(domain string, split *ZoneSplit) (float64, int32) {
+	if split == nil || t.Zone == "" || t.Zones[t.Zone] == 0 {
+		return 1, t.Replicas
+	}
+	var zoned int32
+	var total float64
+	for zone, pods := range t.Zones {
+		if pods > 0 {
+			zoned += pods
+			total += t.weight(domain, split, zone)
+		}
+	}
+	fraction := func(zone string, pods int32) float64 {
+		even := float64(pods) / float64(zoned)
+		if total == 0 {
+			// nothing observed yet, every pod gets the same.
+			return even
+		}
+		if share := t.weight(domain, split, zone) / total; share > minZoneShare*even {
+			return share
+		}
+		return minZoneShare * even
+	}
+	var sum float64
+	for zone, pods := range t.Zones {
+		if pods > 0 {
+			sum += fraction(zone, pods)
+		}
+	}
+	replicas := t.Replicas
+	if replicas < zoned {
+		replicas = zoned
+	}
+	share := fraction(t.Zone, t.Zones[t.Zone]) / sum
+	return share * float64(zoned) / float64(replicas), t.Zones[t.Zone]
+}
@@ -1,39 +1,82 @@
 package config
 
 import (
+	"fmt"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"sort"
 	"strings"
+	"time"
 )
 
 type yamlRateLimit struct {
 	RequestsPerUnit uint32 `yaml:"requests_per_unit"`
 	Unit            string
+	// Requests per Interval replace requests_per_unit and unit, like 3 per 15s.
+	Requests uint32
+	Interval string
 }
 
 func (y *yamlRateLimit) ToRateLimit(key string) (*RateLimit, error) {
 	if y == nil {
 		return nil, nil
 	}
+	return y.toRateLimit(key, Metrics{})
+}
+
+// toRateLimit creates the limit with metrics, or with its own metrics when metrics are zero.
+func (y *yamlRateLimit) toRateLimit(key string, metrics Metrics) (*RateLimit, error) {
+	if y.Interval != "" || y.Requests > 0 {
+		interval, err := time.ParseDuration(y.Interval)
+		if err != nil || interval < time.Second || y.RequestsPerUnit > 0 || y.Unit != "" {
+			return nil, ErrInvalidInterval
+		}
+		if metrics.TotalHits == nil {
+			metrics = NewMetrics(key)
+		}
+		return newIntervalLimit(y.Requests, interval, key, metrics), nil
+	}
 	unit :=
 		pb.RateLimitResponse_RateLimit_Unit_value[strings.ToUpper(y.Unit)]
 	if unit == int32(pb.RateLimitResponse_RateLimit_UNKNOWN) {
 		return nil, ErrInvalidUnit
 	}
-	return NewRateLimit(
-		y.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(unit), key), nil
+	if metrics.TotalHits == nil {
+		return NewRateLimit(
+			y.RequestsPerUnit, pb.RateLimitResponse_RateLimit_Unit(unit), key), nil
+	}
+	return &RateLimit{FullKey: key, Metrics: metrics, RequestsPerUnit: y.RequestsPerUnit,
+		Interval: unitIntervals[pb.RateLimitResponse_RateLimit_Unit(unit)], PerReplica: float64(y.RequestsPerUnit),
+		Limit: &pb.RateLimitResponse_RateLimit{RequestsPerUnit: y.RequestsPerUnit, Unit: pb.RateLimitResponse_RateLimit_Unit(unit)}}, nil
 }
 
 type yamlDescriptor struct {
-	Key         string
-	Value       string
-	RateLimit   *yamlRateLimit `yaml:"rate_limit"`
+	Key       string
+	Value     string
+	RateLimit *yamlRateLimit `yaml:"rate_limit"`
+	// RateLimitRef names a profile of the limits section instead of an inline rate_limit.
+	RateLimitRef string `yaml:"rate_limit_ref"`
+	// Schedules replace the limit while they are active, the first active one wins.
+	Schedules []yamlSchedule
+	// Table is a csv or json file of the config source mapping values to limits or profiles.
+	Table string
+	// Allow and Deny list values exactly, by prefix ending with * or by CIDR.
+	Allow   []string
+	Deny    []string
+	Penalty *yamlPenalty
+	// MaxWait is how long a request may wait for a token instead of going over limit.
+	MaxWait string `yaml:"max_wait"`
+	// Cost is the tokens a hit consumes, CostByValue by the value of the entry.
+	Cost        uint32
+	CostByValue map[string]uint32 `yaml:"cost_by_value"`
 	Descriptors []yamlDescriptor
 }
 
-func (conf *yamlDescriptor) ToDescriptor(parent *Descriptor) (*Descriptor, error) {
+func (conf *yamlDescriptor) ToDescriptor(l *loader, parent *Descriptor, node *yaml.Node) *Descriptor {
 	if conf.Key == "" {
-		return nil, ErrEmptyDescriptor
+		l.fail(node, parent.FullKey, ErrEmptyDescriptor)
+		return nil
 	}
 
 	// Value is optional, so the final key for the map is either the key only or key_value.
@@ -41,27 +84,149 @@ func (conf *yamlDescriptor) ToDescriptor(parent *Descriptor) (*Descriptor, error
 	if conf.Value != "" {
 		key += "_" + conf.Value
 	}
+	finalKey := parent.FullKey + "." + key
 	if _, present := parent.Descriptors[key]; present {
-		return nil, ErrDuplicateDescriptor
+		l.fail(node, finalKey, ErrDuplicateDescriptor)
+		return nil
 	}
 
-	finalKey := parent.FullKey + "." + key
-	rateLimit, err := conf.RateLimit.ToRateLimit(finalKey)
-	if err != nil {
-		return nil, err
-	}
+	rateLimit, err := l.rateLimit(node, conf.RateLimit, conf.RateLimitRef, finalKey)
 	log.Debug().Msgf(
 		"loading descriptor: key=%s %s", finalKey, (*DebugLimit)(rateLimit))
 
-	descriptor := &Descriptor{Descriptors: map[string]*Descriptor{}, Key: key, FullKey: finalKey, Limit: rateLimit}
-	err = descriptor.loadDescriptors(conf.Descriptors)
+	descriptor := &Descriptor{Descriptors: map[string]*Descriptor{}, Key: key, EntryKey: conf.Key, EntryValue: conf.Value, FullKey: finalKey, Limit: rateLimit, File: l.file}
+	if node != nil {
+		descriptor.Line = node.Line
+	}
+	for i, y := range conf.Schedules {
+		scheduleNode := item(field(node, "schedules"), i)
+		limit, err := l.rateLimit(scheduleNode, y.RateLimit, y.RateLimitRef, finalKey)
+		if err != nil {
+			continue
+		}
+		if limit == nil {
+			l.fail(scheduleNode, finalKey, invalidSchedule("%s has no rate_limit", y.Name))
+			continue
+		}
+		schedule, err := y.ToSchedule(limit)
+		if err != nil {
+			l.fail(scheduleNode, finalKey, err)
+			continue
+		}
+		descriptor.Schedules = append(descriptor.Schedules, schedule)
+	}
+	if conf.Table != "" {
+		if conf.Value != "" {
+			l.fail(field(node, "table"), finalKey, ErrTableWithValue)
+		} else {
+			descriptor.Table = l.table(descriptor, conf.Table)
+		}
+	}
+	if conf.Value != "" && (len(conf.Allow) > 0 || len(conf.Deny) > 0) {
+		l.fail(node, finalKey, ErrListWithValue)
+	}
+	var listErr error
+	if descriptor.Allow, listErr = newList(conf.Allow, finalKey, AccessAllow); listErr != nil {
+		l.fail(field(node, "allow"), finalKey, listErr)
+	}
+	if descriptor.Deny, listErr = newList(conf.Deny, finalKey, AccessDeny); listErr != nil {
+		l.fail(field(node, "deny"), finalKey, listErr)
+	}
+	if penalty, err := conf.Penalty.ToPenalty(); err != nil {
+		l.fail(field(node, "penalty"), finalKey, err)
+	} else {
+		descriptor.Penalty = penalty
+	}
+	if conf.MaxWait != "" {
+		if maxWait, err := time.ParseDuration(conf.MaxWait); err != nil || maxWait <= 0 {
+			l.fail(field(node, "max_wait"), finalKey, ErrInvalidMaxWait)
+		} else {
+			descriptor.MaxWait = maxWait
+		}
+	}
+	descriptor.Cost = conf.Cost
+	if err := checkCostByValue(conf.CostByValue); err != nil {
+		l.fail(field(node, "cost_by_value"), finalKey, err)
+	} else {
+		descriptor.CostByValue = conf.CostByValue
+	}
+	descriptor.setLimitOptions()
+	// keep checking the children to report all the errors at once.
+	descriptor.loadDescriptors(l, conf.Descriptors, field(node, "descriptors"))
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	return descriptor, nil
+	return descriptor
+}
+
+// rateLimit resolves the inline limit or the profile named ref, reporting the errors at node.
+func (l *loader) rateLimit(node *yaml.Node, y *yamlRateLimit, ref string, key string) (*RateLimit, error) {
+	switch {
+	case ref != "" && y != nil:
+		l.fail(field(node, "rate_limit_ref"), key, ErrAmbiguousLimit)
+		return nil, ErrAmbiguousLimit
+	case ref != "":
+		profile, ok := l.limits[ref]
+		if !ok {
+			err := fmt.Errorf("%w: %s", ErrUnknownLimitRef, ref)
+			l.fail(field(node, "rate_limit_ref"), key, err)
+			return nil, err
+		}
+		// invalid profiles are reported once with the limits section.
+		return profile.ToRateLimit(key)
+	default:
+		rateLimit, err := y.ToRateLimit(key)
+		if err != nil {
+			l.fail(field(node, "rate_limit"), key, err)
+		}
+		return rateLimit, err
+	}
+}
+
+type yamlZones struct {
+	Split   string
+	Weights map[string]float64
+}
+
+func (y *yamlZones) ToZoneSplit() (*ZoneSplit, error) {
+	if y == nil {
+		return nil, nil
+	}
+	switch y.Split {
+	case ZoneSplitWeight, ZoneSplitDemand:
+	default:
+		return nil, ErrInvalidZoneSplit
+	}
+	for _, weight := range y.Weights {
+		if weight <= 0 {
+			return nil, ErrInvalidZoneWeight
+		}
+	}
+	return &ZoneSplit{Split: y.Split, Weights: y.Weights}, nil
 }
 
 type YamlFile struct {
-	Domain      string
-	Descriptors []yamlDescriptor
+	Domain  string
+	Merge   bool
+	Backend string
+	Zones   *yamlZones
+	// Limits are named limit profiles the descriptors refer to with rate_limit_ref.
+	Limits map[string]*yamlRateLimit
+	// DefaultDescriptor is the limit of the descriptors which match no other limit of the domain.
+	DefaultDescriptor *yamlDefaultDescriptor `yaml:"default_descriptor"`
+	Descriptors       []yamlDescriptor
+}
+
+type yamlDefaultDescriptor struct {
+	RateLimit    *yamlRateLimit `yaml:"rate_limit"`
+	RateLimitRef string         `yaml:"rate_limit_ref"`
+}
+
+func sortedNames(limits map[string]*yamlRateLimit) []string {
+	names := make([]string, 0, len(limits))
+	for name := range limits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
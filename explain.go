@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrInvalidEntry = errors.New("entry must be key=value")
+
+var (
+	ExplainDomain  string
+	ExplainEntries []string
+	ExplainJSON    bool
+	ExplainAt      string
+)
+
+var explainCmd = &cobra.Command{
+	Use:          "explain [dir or file]...",
+	Short:        "Show which limit a descriptor matches.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		descriptor := &pb_struct.RateLimitDescriptor{}
+		for _, e := range ExplainEntries {
+			kv := strings.SplitN(e, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%w: %s", ErrInvalidEntry, e)
+			}
+			descriptor.Entries = append(descriptor.Entries, &pb_struct.RateLimitDescriptor_Entry{Key: kv[0], Value: kv[1]})
+		}
+		files, err := readConfigs(args)
+		if err != nil {
+			return err
+		}
+		conf, errs := config.Load(config.Topology{Replicas: int32(Replicas)}, files, nil)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "ERROR", err)
+		}
+		at := time.Now()
+		if ExplainAt != "" {
+			if at, err = time.Parse(time.RFC3339, ExplainAt); err != nil {
+				return err
+			}
+		}
+		explanation := conf.ExplainAt(ExplainDomain, descriptor, at)
+		if ExplainJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(explanation)
+		}
+		printExplanation(explanation)
+		return nil
+	},
+}
+
+func printExplanation(e *config.Explanation) {
+	fmt.Printf("domain: %s", e.Domain)
+	if !e.KnownDomain {
+		fmt.Print(" (unknown)")
+	}
+	fmt.Println()
+	for _, step := range e.Steps {
+		fmt.Printf("entry %s=%s: ", step.Key, step.Value)
+		switch {
+		case step.Matched == "":
+			fmt.Printf("no match for %s_%s or %s\n", step.Key, step.Value, step.Key)
+		case step.Table != "":
+			fmt.Printf("%s_%s not found, matched %s in table %s\n", step.Key, step.Value, step.Matched, step.Table)
+		case step.Fallback:
+			fmt.Printf("%s_%s not found, matched key only %s\n", step.Key, step.Value, step.Matched)
+		default:
+			fmt.Printf("matched %s\n", step.Matched)
+		}
+	}
+	if e.Access != "" {
+		fmt.Printf("%s: %s\n", e.Access, e.Reason)
+		return
+	}
+	if e.Limit == nil {
+		fmt.Printf("no limit: %s\n", e.Reason)
+		return
+	}
+	if e.Default {
+		fmt.Printf("%s, the default descriptor applies\n", e.Reason)
+	}
+	fmt.Printf("limit: %s %d/%s", e.Limit.FullKey, e.Limit.RequestsPerUnit, e.Limit.Unit)
+	if e.Limit.Schedule != "" {
+		fmt.Printf(" (schedule %s active at %s)", e.Limit.Schedule, e.At.Format(time.RFC3339))
+	}
+	fmt.Println()
+	fmt.Printf("per replica: %g/%s with %d replicas\n", e.Limit.PerReplica, e.Limit.Unit, Replicas)
+	if e.Limit.Cost > 1 {
+		fmt.Printf("cost: %d tokens per hit\n", e.Limit.Cost)
+	}
+	for _, warning := range e.Limit.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+}
+
+func init() {
+	explainCmd.Flags().StringVar(&ExplainDomain, "domain", "", "domain of the request")
+	explainCmd.Flags().StringArrayVarP(&ExplainEntries, "entry", "e", nil, "descriptor entry as key=value, in order")
+	explainCmd.Flags().StringVar(&ExplainAt, "at", "", "RFC 3339 time to evaluate the schedules at, now by default")
+	explainCmd.Flags().BoolVar(&ExplainJSON, "json", false, "print the result as json")
+	rootCmd.AddCommand(explainCmd)
+}
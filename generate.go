@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/generate"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	GenerateDomain  string
+	GenerateMapping string
+	Istio           = generate.Istio{}
+)
+
+var generateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate resources wiring the ratelimit config into a proxy.",
+}
+
+var generateIstioCmd = &cobra.Command{
+	Use:          "istio [dir or file]...",
+	Short:        "Generate the EnvoyFilters inserting the ratelimit filter and the rate limit actions of a domain.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		content, err := ioutil.ReadFile(GenerateMapping)
+		if err != nil {
+			return err
+		}
+		mapping := &generate.Mapping{}
+		if err = yaml.Unmarshal(content, mapping); err != nil {
+			return fmt.Errorf("%s: %w", GenerateMapping, err)
+		}
+		files, err := readConfigs(args)
+		if err != nil {
+			return err
+		}
+		conf, errs := config.Load(config.Topology{Replicas: int32(Replicas)}, files, nil)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "ERROR", err)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%w: %d errors in %d files", ErrInvalidConfig, len(errs), len(files))
+		}
+		if Istio.Name == "" {
+			Istio.Name = "ratelimit-" + GenerateDomain
+		}
+		out, err := Istio.Generate(conf, GenerateDomain, mapping)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	},
+}
+
+func init() {
+	generateIstioCmd.Flags().StringVar(&GenerateDomain, "domain", "", "domain to generate for")
+	generateIstioCmd.Flags().StringVarP(&GenerateMapping, "mapping", "m", "", "yaml file mapping descriptor keys to envoy actions")
+	generateIstioCmd.Flags().StringVar(&Istio.Name, "name", "", "name prefix of the EnvoyFilters, ratelimit-<domain> by default")
+	generateIstioCmd.Flags().StringVarP(&Istio.Namespace, "namespace", "n", "istio-system", "namespace of the EnvoyFilters")
+	generateIstioCmd.Flags().StringVar(&Istio.Context, "context", "GATEWAY", "patch context: GATEWAY, SIDECAR_INBOUND or SIDECAR_OUTBOUND")
+	generateIstioCmd.Flags().StringToStringVar(&Istio.Selector, "selector", map[string]string{"istio": "ingressgateway"}, "workload selector labels")
+	generateIstioCmd.Flags().StringVar(&Istio.Cluster, "cluster", "outbound|8081||ratelimit.istio-system.svc.cluster.local", "envoy cluster of the ratelimit service")
+	generateIstioCmd.Flags().StringVar(&Istio.Timeout, "timeout", "0.05s", "timeout of the ratelimit calls")
+	generateIstioCmd.Flags().BoolVar(&Istio.FailClose, "fail_close", false, "deny requests when the ratelimit service fails")
+	_ = generateIstioCmd.MarkFlagRequired("domain")
+	_ = generateIstioCmd.MarkFlagRequired("mapping")
+	generateCmd.AddCommand(generateIstioCmd)
+	rootCmd.AddCommand(generateCmd)
+}
@@ -0,0 +1,289 @@
+package generate
+
+import (
+	"errors"
+	"fmt"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownDomain  = errors.New("unknown domain")
+	ErrNoAction       = errors.New("no action mapped for descriptor key")
+	ErrInvalidAction  = errors.New("action must set exactly one of header, remote_address and generic_key")
+	ErrRemoteAddress  = errors.New("remote_address action only produces the descriptor key remote_address")
+	ErrGenericNoValue = errors.New("generic_key action needs a descriptor value")
+)
+
+// Action tells how envoy produces the entry of a descriptor key.
+type Action struct {
+	// Header is the request header whose value is the entry value.
+	Header string `yaml:"header"`
+	// RemoteAddress uses the trusted client address, the key must be remote_address.
+	RemoteAddress bool `yaml:"remote_address"`
+	// GenericKey uses the value of the descriptor in the config as is.
+	GenericKey bool `yaml:"generic_key"`
+}
+
+// Route selects the routes getting the rate limit actions.
+type Route struct {
+	// Name is the name of the route, the name of the http route of the VirtualService.
+	Name string `yaml:"name"`
+	// VirtualHost restricts the match to the routes of a virtual host, like example.com:80.
+	VirtualHost string `yaml:"vhost"`
+}
+
+// Mapping maps the descriptor keys of the config to envoy actions.
+type Mapping struct {
+	Actions map[string]Action `yaml:"actions"`
+	// Routes get the rate limit actions, all the routes when empty.
+	Routes []Route `yaml:"routes"`
+}
+
+// Istio is where and how the EnvoyFilter resources are generated.
+type Istio struct {
+	Name      string
+	Namespace string
+	// Context is the patch context, GATEWAY, SIDECAR_INBOUND or SIDECAR_OUTBOUND.
+	Context string
+	// Selector is the workload selector labels, all workloads in the namespace if empty.
+	Selector map[string]string
+	// Cluster is the envoy cluster of the ratelimit service.
+	Cluster   string
+	Timeout   string
+	FailClose bool
+}
+
+type envoyFilter struct {
+	APIVersion string          `yaml:"apiVersion"`
+	Kind       string          `yaml:"kind"`
+	Metadata   metadata        `yaml:"metadata"`
+	Spec       envoyFilterSpec `yaml:"spec"`
+}
+
+type metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+}
+
+type envoyFilterSpec struct {
+	WorkloadSelector *workloadSelector `yaml:"workloadSelector,omitempty"`
+	ConfigPatches    []configPatch     `yaml:"configPatches"`
+}
+
+type workloadSelector struct {
+	Labels map[string]string `yaml:"labels"`
+}
+
+type configPatch struct {
+	ApplyTo string                 `yaml:"applyTo"`
+	Match   map[string]interface{} `yaml:"match"`
+	Patch   patch                  `yaml:"patch"`
+}
+
+type patch struct {
+	Operation string                 `yaml:"operation"`
+	Value     map[string]interface{} `yaml:"value"`
+}
+
+type rateLimit struct {
+	Actions []map[string]interface{} `yaml:"actions"`
+}
+
+// actions returns the route rate limits producing the descriptors of the domain which have a limit or
+// an allow or deny list, one per path of descriptor keys from the domain root.
+func (m *Mapping) actions(domain *config.Domain) ([]rateLimit, error) {
+	var limits []rateLimit
+	var errs []string
+	var walk func(d *config.Descriptor, actions []map[string]interface{})
+	walk = func(d *config.Descriptor, actions []map[string]interface{}) {
+		for _, key := range sortedKeys(d.Descriptors) {
+			child := d.Descriptors[key]
+			action, err := m.action(child)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", child.FullKey, err))
+				continue
+			}
+			path := append(append([]map[string]interface{}(nil), actions...), action)
+			if decides(child) && !contains(limits, path) {
+				limits = append(limits, rateLimit{Actions: path})
+			}
+			walk(child, path)
+		}
+	}
+	walk(&domain.Descriptor, nil)
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+	return limits, nil
+}
+
+// routePatches merges the rate limits into each of the routes.
+func (m *Mapping) routePatches(context string, limits []rateLimit) []configPatch {
+	routes := m.Routes
+	if len(routes) == 0 {
+		routes = []Route{{}}
+	}
+	patches := make([]configPatch, 0, len(routes))
+	for _, route := range routes {
+		vhost := map[string]interface{}{"route": map[string]interface{}{"action": "ANY"}}
+		if route.Name != "" {
+			vhost["route"] = map[string]interface{}{"name": route.Name}
+		}
+		if route.VirtualHost != "" {
+			vhost["name"] = route.VirtualHost
+		}
+		patches = append(patches, configPatch{
+			ApplyTo: "HTTP_ROUTE",
+			Match: map[string]interface{}{
+				"context":            context,
+				"routeConfiguration": map[string]interface{}{"vhost": vhost},
+			},
+			Patch: patch{
+				Operation: "MERGE",
+				Value:     map[string]interface{}{"route": map[string]interface{}{"rate_limits": limits}},
+			},
+		})
+	}
+	return patches
+}
+
+func (m *Mapping) action(d *config.Descriptor) (map[string]interface{}, error) {
+	action, ok := m.Actions[d.EntryKey]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrNoAction, d.EntryKey)
+	}
+	set := 0
+	for _, b := range []bool{action.Header != "", action.RemoteAddress, action.GenericKey} {
+		if b {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("%s: %w", d.EntryKey, ErrInvalidAction)
+	}
+	switch {
+	case action.Header != "":
+		return map[string]interface{}{
+			"request_headers": map[string]interface{}{"header_name": action.Header, "descriptor_key": d.EntryKey},
+		}, nil
+	case action.RemoteAddress:
+		if d.EntryKey != "remote_address" {
+			return nil, fmt.Errorf("%s: %w", d.EntryKey, ErrRemoteAddress)
+		}
+		return map[string]interface{}{"remote_address": map[string]interface{}{}}, nil
+	default:
+		if d.EntryValue == "" {
+			return nil, fmt.Errorf("%s: %w", d.EntryKey, ErrGenericNoValue)
+		}
+		return map[string]interface{}{
+			"generic_key": map[string]interface{}{"descriptor_key": d.EntryKey, "descriptor_value": d.EntryValue},
+		}, nil
+	}
+}
+
+// Generate renders the EnvoyFilter inserting the ratelimit http filter for the domain and the one
+// adding the rate limit actions to the routes.
+func (i *Istio) Generate(conf *config.Config, domainName string, mapping *Mapping) ([]byte, error) {
+	domain := conf.Domain(domainName)
+	if domain == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDomain, domainName)
+	}
+	limits, err := mapping.actions(domain)
+	if err != nil {
+		return nil, err
+	}
+	var selector *workloadSelector
+	if len(i.Selector) > 0 {
+		selector = &workloadSelector{Labels: i.Selector}
+	}
+	filter := envoyFilter{
+		APIVersion: "networking.istio.io/v1alpha3",
+		Kind:       "EnvoyFilter",
+		Metadata:   metadata{Name: i.Name + "-filter", Namespace: i.Namespace},
+		Spec: envoyFilterSpec{
+			WorkloadSelector: selector,
+			ConfigPatches: []configPatch{{
+				ApplyTo: "HTTP_FILTER",
+				Match: map[string]interface{}{
+					"context": i.Context,
+					"listener": map[string]interface{}{
+						"filterChain": map[string]interface{}{
+							"filter": map[string]interface{}{
+								"name":      "envoy.filters.network.http_connection_manager",
+								"subFilter": map[string]interface{}{"name": "envoy.filters.http.router"},
+							},
+						},
+					},
+				},
+				Patch: patch{
+					Operation: "INSERT_BEFORE",
+					Value: map[string]interface{}{
+						"name": "envoy.filters.http.ratelimit",
+						"typed_config": map[string]interface{}{
+							"@type":             "type.googleapis.com/envoy.extensions.filters.http.ratelimit.v3.RateLimit",
+							"domain":            domain.FullKey,
+							"failure_mode_deny": i.FailClose,
+							"timeout":           i.Timeout,
+							"rate_limit_service": map[string]interface{}{
+								"grpc_service": map[string]interface{}{
+									"envoy_grpc": map[string]interface{}{"cluster_name": i.Cluster},
+									"timeout":    i.Timeout,
+								},
+								"transport_api_version": "V3",
+							},
+						},
+					},
+				},
+			}},
+		},
+	}
+	actions := envoyFilter{
+		APIVersion: "networking.istio.io/v1alpha3",
+		Kind:       "EnvoyFilter",
+		Metadata:   metadata{Name: i.Name + "-actions", Namespace: i.Namespace},
+		Spec: envoyFilterSpec{
+			WorkloadSelector: selector,
+			ConfigPatches:    mapping.routePatches(i.Context, limits),
+		},
+	}
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(filter); err != nil {
+		return nil, err
+	}
+	if err = encoder.Encode(actions); err != nil {
+		return nil, err
+	}
+	if err = encoder.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// decides reports whether the descriptor has a limit or a list deciding the status of its values.
+func decides(d *config.Descriptor) bool {
+	return d.Limit != nil || d.Table != nil || d.Allow != nil || d.Deny != nil
+}
+
+func contains(limits []rateLimit, actions []map[string]interface{}) bool {
+	for _, l := range limits {
+		if reflect.DeepEqual(l.Actions, actions) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]*config.Descriptor) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
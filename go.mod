@@ -3,8 +3,10 @@ module github.com/istio-conductor/shard-ratelimit
 go 1.16
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/envoyproxy/go-control-plane v0.9.9-0.20210217033140-668b12f5399d
 	github.com/fsnotify/fsnotify v1.4.9
+	github.com/mediocregopher/radix/v3 v3.7.0
 	github.com/prometheus/client_golang v1.11.0
 	github.com/rs/zerolog v1.23.0
 	github.com/spf13/cobra v1.1.3
@@ -16,7 +18,9 @@ require (
 	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 	google.golang.org/genproto v0.0.0-20210602131652-f16073e35f0c // indirect
 	google.golang.org/grpc v1.38.0
+	google.golang.org/protobuf v1.26.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	k8s.io/api v0.21.2
 	k8s.io/apimachinery v0.21.2
 	k8s.io/client-go v0.21.2
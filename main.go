@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"errors"
+	"github.com/istio-conductor/shard-ratelimit/bucket"
 	"github.com/istio-conductor/shard-ratelimit/misc/signals"
+	"github.com/istio-conductor/shard-ratelimit/reloader/configmap"
 	"github.com/istio-conductor/shard-ratelimit/server"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"os"
+	"time"
 )
 
 var (
@@ -20,6 +24,50 @@ var (
 	Namespace string
 	Service   string
 	ConfigMap string
+
+	PodIP         string
+	PeerToken     string
+	Borrow        bool
+	BorrowTimeout time.Duration
+	BorrowLease   time.Duration
+	BorrowSize    int
+
+	RedisURL          string
+	RedisPerSecondURL string
+	RedisPoolSize     int
+	RedisPrefix       string
+
+	Mode              string
+	ReconcileInterval time.Duration
+	ReconcileStore    string
+
+	ZoneAware      bool
+	DemandInterval time.Duration
+
+	Discovery         string
+	DiscoveryInterval time.Duration
+	DNSName           string
+	DNSSRV            bool
+	Peers             []string
+	PeersFile         string
+
+	StrictConfig bool
+
+	CRD          bool
+	CRDNamespace string
+	CRDSelector  string
+
+	ConfigMapSelector      string
+	ConfigMapAllNamespaces bool
+	ConfigMapPolicy        string
+
+	AdminToken        string
+	OverrideConfigMap string
+
+	UnknownDomain  string
+	DefaultLimit   string
+	PenaltyEntries int
+	MaxWaiters     int
 )
 
 var rootCmd = &cobra.Command{
@@ -36,6 +84,40 @@ var rootCmd = &cobra.Command{
 		})
 		ctx := signals.Context()
 		s := server.New(GrpcPort, HTTPPort, WatchDir, Namespace, Service, ConfigMap, Replicas)
+		s.PodIP = PodIP
+		s.PeerToken = PeerToken
+		s.Borrow = Borrow
+		s.BorrowTimeout = BorrowTimeout
+		s.BorrowLease = BorrowLease
+		s.BorrowSize = BorrowSize
+		s.RedisURL = RedisURL
+		s.RedisPerSecondURL = RedisPerSecondURL
+		s.RedisPoolSize = RedisPoolSize
+		s.RedisPrefix = RedisPrefix
+		s.Mode = Mode
+		s.ReconcileInterval = ReconcileInterval
+		s.ReconcileStore = ReconcileStore
+		s.ZoneAware = ZoneAware
+		s.DemandInterval = DemandInterval
+		s.Discovery = Discovery
+		s.DiscoveryInterval = DiscoveryInterval
+		s.DNSName = DNSName
+		s.DNSSRV = DNSSRV
+		s.Peers = Peers
+		s.PeersFile = PeersFile
+		s.StrictConfig = StrictConfig
+		s.UnknownDomain = UnknownDomain
+		s.DefaultLimit = DefaultLimit
+		s.PenaltyEntries = PenaltyEntries
+		s.MaxWaiters = MaxWaiters
+		s.CRD = CRD
+		s.CRDNamespace = CRDNamespace
+		s.CRDSelector = CRDSelector
+		s.ConfigMapSelector = ConfigMapSelector
+		s.ConfigMapAllNamespaces = ConfigMapAllNamespaces
+		s.ConfigMapPolicy = configmap.Policy(ConfigMapPolicy)
+		s.AdminToken = AdminToken
+		s.OverrideConfigMap = OverrideConfigMap
 		err := s.Run(ctx)
 		if errors.Is(err, context.Canceled) {
 			return nil
@@ -58,6 +140,47 @@ func init() {
 	rootCmd.PersistentFlags().StringVarP(&Namespace, "namespace", "n", "istio-system", "namespace")
 	rootCmd.PersistentFlags().StringVarP(&Service, "service", "s", "ratelimit", "service name")
 	rootCmd.PersistentFlags().StringVarP(&ConfigMap, "configmap", "c", "", "configmap name")
+	rootCmd.PersistentFlags().StringVar(&ConfigMapSelector, "configmap_selector", "", "label selector of the configmaps to watch instead of --configmap")
+	rootCmd.PersistentFlags().StringVar(&ConfigMapPolicy, "configmap_policy", "keep", "when the configmap is deleted or missing: keep, clear or notready")
+	rootCmd.PersistentFlags().BoolVar(&ConfigMapAllNamespaces, "configmap_all_namespaces", false, "watch the selected configmaps in all namespaces")
+
+	rootCmd.PersistentFlags().StringVar(&AdminToken, "admin_token", os.Getenv("ADMIN_TOKEN"), "bearer token of the admin API, which is disabled without it")
+	rootCmd.PersistentFlags().StringVar(&OverrideConfigMap, "override_configmap", "", "configmap sharing the runtime overrides among the replicas")
+	rootCmd.PersistentFlags().StringVar(&PodIP, "pod_ip", os.Getenv("POD_IP"), "ip of this replica, excluded from the borrow peers")
+	rootCmd.PersistentFlags().StringVar(&PeerToken, "peer_token", os.Getenv("PEER_TOKEN"), "bearer token shared by the replicas, the peer endpoints only serve the known members without it")
+	rootCmd.PersistentFlags().BoolVar(&Borrow, "borrow", false, "borrow tokens from peers when the local shard is exhausted")
+	rootCmd.PersistentFlags().DurationVar(&BorrowTimeout, "borrow_timeout", 20*time.Millisecond, "latency budget of a borrow")
+	rootCmd.PersistentFlags().DurationVar(&BorrowLease, "borrow_lease", time.Second, "lifetime of borrowed tokens")
+	rootCmd.PersistentFlags().IntVar(&BorrowSize, "borrow_size", 10, "tokens to borrow at once")
+
+	rootCmd.PersistentFlags().StringVar(&RedisURL, "redis_url", "", "redis for the domains with the redis backend")
+	rootCmd.PersistentFlags().StringVar(&RedisPerSecondURL, "redis_per_second_url", "", "redis for the per second limits")
+	rootCmd.PersistentFlags().IntVar(&RedisPoolSize, "redis_pool_size", 10, "redis connection pool size")
+	rootCmd.PersistentFlags().StringVar(&RedisPrefix, "redis_prefix", "", "prefix of the redis cache keys")
+
+	rootCmd.PersistentFlags().StringVar(&Mode, "mode", server.ModeLocal, "local or hybrid, which reconciles the local shards with the other replicas")
+	rootCmd.PersistentFlags().DurationVar(&ReconcileInterval, "reconcile_interval", time.Second, "interval of the hybrid reconciliation")
+	rootCmd.PersistentFlags().StringVar(&ReconcileStore, "reconcile_store", server.StorePeers, "peers or redis, where the consumption is shared")
+
+	rootCmd.PersistentFlags().BoolVar(&ZoneAware, "zone_aware", false, "split the limits among the zones of the replicas, read from the EndpointSlices")
+	rootCmd.PersistentFlags().DurationVar(&DemandInterval, "demand_interval", 10*time.Second, "interval of polling the demand per zone")
+
+	rootCmd.PersistentFlags().StringVar(&Discovery, "discovery", server.DiscoveryKubernetes, "how the replicas are discovered: kubernetes, dns, static or gossip")
+	rootCmd.PersistentFlags().DurationVar(&DiscoveryInterval, "discovery_interval", 5*time.Second, "interval of dns polling, peers file polling and gossip rounds")
+	rootCmd.PersistentFlags().StringVar(&DNSName, "dns_name", "", "headless name resolving to the replicas")
+	rootCmd.PersistentFlags().BoolVar(&DNSSRV, "dns_srv", false, "lookup SRV instead of A records")
+	rootCmd.PersistentFlags().StringSliceVar(&Peers, "peers", nil, "static peers, or the seeds of gossip")
+	rootCmd.PersistentFlags().StringVar(&PeersFile, "peers_file", "", "file with one static peer per line")
+
+	rootCmd.PersistentFlags().BoolVar(&StrictConfig, "strict_config", false, "keep the whole last known good config when any file fails to load")
+	rootCmd.PersistentFlags().StringVar(&UnknownDomain, "unknown_domain", "allow", "policy of the domains missing from the config: allow or deny")
+	rootCmd.PersistentFlags().IntVar(&PenaltyEntries, "penalty_entries", bucket.DefaultPenaltyEntries, "values the penalties remember at most, the least recently seen are forgotten first")
+	rootCmd.PersistentFlags().IntVar(&MaxWaiters, "max_waiters", bucket.DefaultMaxWaiters, "requests waiting for a token of a descriptor with max_wait at once, the others are over limit")
+	rootCmd.PersistentFlags().StringVar(&DefaultLimit, "default_limit", "", "limit like 100/second or 100/10s of the descriptors without a limit, of the domains without default_descriptor")
+
+	rootCmd.PersistentFlags().BoolVar(&CRD, "crd", false, "load the RateLimitConfig objects besides the configmap or directory")
+	rootCmd.PersistentFlags().StringVar(&CRDNamespace, "crd_namespace", "", "namespace of the RateLimitConfig objects, all namespaces when empty")
+	rootCmd.PersistentFlags().StringVar(&CRDSelector, "crd_selector", "", "label selector of the RateLimitConfig objects")
 
 }
 
@@ -73,6 +196,6 @@ func main() {
 	err := rootCmd.Execute()
 	if err != nil {
 		log.Err(err).Msg("process exit")
-		return
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,131 @@
+package override
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const Path = "/admin/overrides"
+
+var (
+	ErrMissingDescriptor = errors.New("domain and path are required")
+	ErrInvalidTTL        = errors.New("ttl must be a positive duration")
+)
+
+// overrideRequest is the body to set an override, which lasts for ttl. The limit is given with
+// requests_per_unit and unit, or with requests and interval.
+type overrideRequest struct {
+	Domain          string `json:"domain"`
+	Path            string `json:"path"`
+	RequestsPerUnit uint32 `json:"requests_per_unit"`
+	Unit            string `json:"unit"`
+	Requests        uint32 `json:"requests"`
+	Interval        string `json:"interval"`
+	TTL             string `json:"ttl"`
+	Reason          string `json:"reason"`
+}
+
+// Authorized wraps handler to require the bearer token.
+func Authorized(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Handler lists the overrides on GET, sets one on POST after check and removes one on DELETE with the
+// domain and path query parameters.
+func Handler(store Store, check func(o *config.Override) error) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			state := store.State().copy()
+			state.prune(time.Now())
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(state.Overrides)
+		case http.MethodPost:
+			var req overrideRequest
+			if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			o, err := req.toOverride()
+			if err == nil {
+				err = check(o)
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = store.Update(request.Context(), func(state *State) {
+				state.remove(o.Domain, o.Path)
+				state.Overrides = append(state.Overrides, *o)
+			})
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info().Msgf("override %s set to %s until %s: %s", o.FullKey(), o.Limit(), o.Expires, o.Reason)
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(o)
+		case http.MethodDelete:
+			domain, path := request.URL.Query().Get("domain"), request.URL.Query().Get("path")
+			if domain == "" || path == "" {
+				http.Error(writer, ErrMissingDescriptor.Error(), http.StatusBadRequest)
+				return
+			}
+			err := store.Update(request.Context(), func(state *State) {
+				state.remove(domain, path)
+			})
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info().Msgf("override %s.%s removed", domain, path)
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (r *overrideRequest) toOverride() (*config.Override, error) {
+	if r.Domain == "" || r.Path == "" {
+		return nil, ErrMissingDescriptor
+	}
+	ttl, err := time.ParseDuration(r.TTL)
+	if err != nil || ttl <= 0 {
+		return nil, ErrInvalidTTL
+	}
+	o := &config.Override{
+		Domain:          r.Domain,
+		Path:            r.Path,
+		RequestsPerUnit: r.RequestsPerUnit,
+		Unit:            r.Unit,
+		Requests:        r.Requests,
+		Interval:        r.Interval,
+		Expires:         time.Now().Add(ttl).UTC(),
+		Reason:          r.Reason,
+	}
+	return o, nil
+}
+
+func (s *State) remove(domain, path string) {
+	overrides := s.Overrides[:0]
+	for _, o := range s.Overrides {
+		if o.Domain != domain || o.Path != path {
+			overrides = append(overrides, o)
+		}
+	}
+	s.Overrides = overrides
+}
@@ -0,0 +1,229 @@
+package override
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"reflect"
+	kubeconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sync"
+	"time"
+)
+
+// DataKey is the key of the state in the configmap.
+const DataKey = "overrides.json"
+
+// State is the runtime state shared by the replicas.
+type State struct {
+	Overrides []config.Override `json:"overrides,omitempty"`
+	Switches  []Switch          `json:"switches,omitempty"`
+}
+
+// prune drops the expired entries.
+func (s *State) prune(now time.Time) {
+	overrides := s.Overrides[:0]
+	for _, o := range s.Overrides {
+		if !o.Expired(now) {
+			overrides = append(overrides, o)
+		}
+	}
+	s.Overrides = overrides
+	switches := s.Switches[:0]
+	for _, sw := range s.Switches {
+		if sw.Active(now) {
+			switches = append(switches, sw)
+		}
+	}
+	s.Switches = switches
+}
+
+func (s *State) copy() *State {
+	c := &State{}
+	c.Overrides = append(c.Overrides, s.Overrides...)
+	c.Switches = append(c.Switches, s.Switches...)
+	return c
+}
+
+// Store keeps the state and reports its changes.
+type Store interface {
+	// State returns the current state, which must not be modified.
+	State() *State
+	// Update applies mutate to the state.
+	Update(ctx context.Context, mutate func(state *State)) error
+	Run(ctx context.Context) error
+}
+
+// Memory keeps the state in this replica only.
+type Memory struct {
+	mu       sync.Mutex
+	state    *State
+	onUpdate func(state *State)
+}
+
+func NewMemory(onUpdate func(state *State)) *Memory {
+	return &Memory{state: &State{}, onUpdate: onUpdate}
+}
+
+func (m *Memory) State() *State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *Memory) Update(ctx context.Context, mutate func(state *State)) error {
+	m.mu.Lock()
+	state := m.state.copy()
+	mutate(state)
+	state.prune(time.Now())
+	m.state = state
+	m.mu.Unlock()
+	m.onUpdate(state)
+	return nil
+}
+
+func (m *Memory) Run(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ConfigMap keeps the state in a configmap every replica watches.
+type ConfigMap struct {
+	namespace string
+	name      string
+	kube      kubernetes.Interface
+	onUpdate  func(state *State)
+
+	mu    sync.Mutex
+	state *State
+}
+
+func NewConfigMap(namespace string, name string, onUpdate func(state *State)) (*ConfigMap, error) {
+	c, err := kubeconfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	k, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &ConfigMap{namespace: namespace, name: name, kube: k, onUpdate: onUpdate, state: &State{}}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	cm, err := k.CoreV1().ConfigMaps(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil {
+		s.set(cm)
+	}
+	return s, nil
+}
+
+func decode(cm *corev1.ConfigMap) (*State, error) {
+	state := &State{}
+	if content, ok := cm.Data[DataKey]; ok {
+		if err := json.Unmarshal([]byte(content), state); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+func (s *ConfigMap) set(cm *corev1.ConfigMap) {
+	state, err := decode(cm)
+	if err != nil {
+		log.Error().Err(err).Msgf("decode %s/%s failed", s.namespace, s.name)
+		return
+	}
+	s.mu.Lock()
+	if reflect.DeepEqual(state, s.state) {
+		s.mu.Unlock()
+		return
+	}
+	s.state = state
+	s.mu.Unlock()
+	s.onUpdate(state)
+}
+
+func (s *ConfigMap) State() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Update writes the mutated state to the configmap, the replicas apply it when they see the change.
+func (s *ConfigMap) Update(ctx context.Context, mutate func(state *State)) error {
+	configMaps := s.kube.CoreV1().ConfigMaps(s.namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, s.name, v1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+		if notFound {
+			cm = &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: s.name, Namespace: s.namespace}}
+		}
+		state, err := decode(cm)
+		if err != nil {
+			// a corrupted state is replaced.
+			state = &State{}
+		}
+		mutate(state)
+		state.prune(time.Now())
+		content, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[DataKey] = string(content)
+		if notFound {
+			_, err = configMaps.Create(ctx, cm, v1.CreateOptions{})
+		} else {
+			_, err = configMaps.Update(ctx, cm, v1.UpdateOptions{})
+		}
+		if apierrors.IsAlreadyExists(err) {
+			// created by another replica meanwhile, retry as an update.
+			return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+		}
+		return err
+	})
+}
+
+func (s *ConfigMap) OnAdd(obj interface{}) {
+	if cm, ok := obj.(*corev1.ConfigMap); ok {
+		s.set(cm)
+	}
+}
+
+func (s *ConfigMap) OnUpdate(oldObj, obj interface{}) {
+	s.OnAdd(obj)
+}
+
+func (s *ConfigMap) OnDelete(obj interface{}) {
+	s.mu.Lock()
+	s.state = &State{}
+	s.mu.Unlock()
+	s.onUpdate(&State{})
+}
+
+func (s *ConfigMap) Run(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.kube, time.Minute*15,
+		informers.WithNamespace(s.namespace), informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector(v1.ObjectNameField, s.name).String()
+		}))
+	i := factory.Core().V1().ConfigMaps().Informer()
+	i.AddEventHandler(s)
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	return ctx.Err()
+}
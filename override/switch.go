@@ -0,0 +1,163 @@
+package override
+
+import (
+	"encoding/json"
+	"errors"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const SwitchPath = "/admin/switches"
+
+const (
+	// ModeAllow answers OK without checking the limits.
+	ModeAllow = "allow"
+	// ModeDeny answers OVER_LIMIT without checking the limits.
+	ModeDeny = "deny"
+)
+
+var (
+	ErrMissingDomain = errors.New("domain is required")
+	ErrInvalidMode   = errors.New("mode must be allow or deny")
+)
+
+// Entry matches a descriptor entry, any value when the value is empty.
+type Entry struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Switch forces the status of the descriptors of a domain starting with its entries, of all the
+// descriptors of the domain without entries.
+type Switch struct {
+	Domain  string     `json:"domain"`
+	Entries []Entry    `json:"entries,omitempty"`
+	Mode    string     `json:"mode"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// Active reports whether the switch applies at t, a switch without expiry applies until removed.
+func (s *Switch) Active(t time.Time) bool {
+	return s.Expires == nil || t.Before(*s.Expires)
+}
+
+// Matches reports whether the descriptor is in the subtree of the switch.
+func (s *Switch) Matches(entries []*pb_struct.RateLimitDescriptor_Entry) bool {
+	if len(entries) < len(s.Entries) {
+		return false
+	}
+	for i, e := range s.Entries {
+		if entries[i].Key != e.Key || e.Value != "" && entries[i].Value != e.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// Same reports whether both switch the same subtree.
+func (s *Switch) Same(other *Switch) bool {
+	if s.Domain != other.Domain || len(s.Entries) != len(other.Entries) {
+		return false
+	}
+	for i := range s.Entries {
+		if s.Entries[i] != other.Entries[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Subtree names the switched descriptors like key_value.key.
+func (s *Switch) Subtree() string {
+	keys := make([]string, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		if e.Value == "" {
+			keys = append(keys, e.Key)
+			continue
+		}
+		keys = append(keys, e.Key+"_"+e.Value)
+	}
+	return strings.Join(keys, ".")
+}
+
+func (s *State) removeSwitch(sw *Switch) {
+	switches := s.Switches[:0]
+	for i := range s.Switches {
+		if !s.Switches[i].Same(sw) {
+			switches = append(switches, s.Switches[i])
+		}
+	}
+	s.Switches = switches
+}
+
+// switchRequest is the body to set a switch, which lasts for ttl or until removed without ttl.
+type switchRequest struct {
+	Switch
+	TTL string `json:"ttl"`
+}
+
+// SwitchHandler lists the switches on GET, sets one on POST and removes the one with the domain and entries
+// of the body on DELETE.
+func SwitchHandler(store Store) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method == http.MethodGet {
+			state := store.State().copy()
+			state.prune(time.Now())
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(state.Switches)
+			return
+		}
+		if request.Method != http.MethodPost && request.Method != http.MethodDelete {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var req switchRequest
+		if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sw := req.Switch
+		if sw.Domain == "" {
+			http.Error(writer, ErrMissingDomain.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.Method == http.MethodDelete {
+			if err := store.Update(request.Context(), func(state *State) { state.removeSwitch(&sw) }); err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Info().Msgf("switch %s %s removed", sw.Domain, sw.Subtree())
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if sw.Mode != ModeAllow && sw.Mode != ModeDeny {
+			http.Error(writer, ErrInvalidMode.Error(), http.StatusBadRequest)
+			return
+		}
+		sw.Expires = nil
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				http.Error(writer, ErrInvalidTTL.Error(), http.StatusBadRequest)
+				return
+			}
+			expires := time.Now().Add(ttl).UTC()
+			sw.Expires = &expires
+		}
+		err := store.Update(request.Context(), func(state *State) {
+			state.removeSwitch(&sw)
+			state.Switches = append(state.Switches, sw)
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Warn().Msgf("switch %s %s set to %s: %s", sw.Domain, sw.Subtree(), sw.Mode, sw.Reason)
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(sw)
+	})
+}
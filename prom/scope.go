@@ -110,3 +110,120 @@ func NewPoolStat(prefix string) PoolStat {
 
 var RedisPerSecondPool = NewPoolStat("per_second_pool")
 var RedisPool = NewPoolStat("pool")
+
+var BorrowSuccess = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "borrow_success",
+})
+
+var BorrowFailed = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "borrow_failed",
+})
+
+var LendTokens = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "lend_tokens",
+})
+
+var ReconcileError = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "reconcile_error",
+})
+
+var ReconcilePenalty = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "reconcile_penalty_tokens",
+})
+
+var ConfigFileStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "config_file_status",
+	Help:      "1 when the config file loaded, 0 when it failed.",
+}, []string{"file"})
+
+var ConfigMapMissing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "configmap_missing",
+	Help:      "1 while the watched configmap is deleted or doesn't exist, with the policy applied.",
+}, []string{"configmap", "policy"})
+
+var KillSwitch = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "kill_switch",
+	Help:      "1 while a kill switch forces the status of a domain or descriptor subtree.",
+}, []string{"domain", "descriptor", "mode"})
+
+var KillSwitchHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "kill_switch_hits",
+	Help:      "Descriptors whose status was forced by a kill switch.",
+}, []string{"domain", "mode"})
+
+var UnknownDomainDenied = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "unknown_domain_denied",
+	Help:      "Requests denied because their domain is missing from the config.",
+})
+
+var ListHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "list_hits",
+	Help:      "Descriptors whose status was decided by an allow or deny list.",
+}, []string{"domain", "access"})
+
+var PenaltyBans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "penalty_bans",
+	Help:      "Values banned for going over the limit too often.",
+}, []string{"descriptor"})
+
+var PenaltyRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "penalty_rejected",
+	Help:      "Descriptors rejected because their value is banned.",
+}, []string{"descriptor"})
+
+var PenaltyEvicted = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "penalty_evicted",
+	Help:      "Values forgotten by the penalties to stay within their maximum entries.",
+})
+
+var QueueWaiters = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "queue_waiters",
+	Help:      "Requests waiting for a token.",
+})
+
+var QueueWaited = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "queue_wait_milliseconds",
+	Help:      "Time the requests waited for a token before OK.",
+	Buckets: []float64{
+		1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000,
+	},
+})
+
+var QueueFull = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: ComponentService,
+	Name:      "queue_full",
+	Help:      "Requests over limit because the maximum of waiters was reached.",
+})
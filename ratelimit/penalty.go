@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/bucket"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PenaltiesPath lists the active bans, which are local to the replica.
+const PenaltiesPath = "/admin/penalties"
+
+// WithPenaltyEntries bounds the values the penalties remember.
+func (s *Service) WithPenaltyEntries(max int) *Service {
+	s.penalties = bucket.NewPenalties(max)
+	return s
+}
+
+// penaltyValue names the value of a descriptor like key=value,key=value.
+func penaltyValue(descriptor *pb_struct.RateLimitDescriptor) string {
+	var b strings.Builder
+	for i, entry := range descriptor.Entries {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(entry.Key)
+		b.WriteByte('=')
+		b.WriteString(entry.Value)
+	}
+	return b.String()
+}
+
+// banned reports whether the value of the descriptor is banned from its limit.
+func (s *Service) banned(limit *config.RateLimit, descriptor *pb_struct.RateLimitDescriptor, now time.Time) bool {
+	if limit == nil || limit.Penalty == nil {
+		return false
+	}
+	if !s.penalties.Banned(limit.FullKey, penaltyValue(descriptor), now) {
+		return false
+	}
+	prom.PenaltyRejected.WithLabelValues(limit.FullKey).Inc()
+	return true
+}
+
+// violations records the over limit answers of the limits with a penalty.
+func (s *Service) violations(request *pb.RateLimitRequest, limits []*config.RateLimit,
+	statuses []*pb.RateLimitResponse_DescriptorStatus, now time.Time) {
+	for i, limit := range limits {
+		if limit == nil || limit.Penalty == nil || statuses[i].Code != pb.RateLimitResponse_OVER_LIMIT {
+			continue
+		}
+		s.penalties.Violation(limit.FullKey, penaltyValue(request.Descriptors[i]), limit.Penalty, now)
+	}
+}
+
+// PenaltiesHandler lists the active bans on GET and lifts the ban of the descriptor and value query
+// parameters on DELETE.
+func PenaltiesHandler(s *Service) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.Method {
+		case http.MethodGet:
+			writer.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(writer).Encode(s.penalties.Bans(time.Now()))
+		case http.MethodDelete:
+			descriptor, value := request.URL.Query().Get("descriptor"), request.URL.Query().Get("value")
+			if !s.penalties.Lift(descriptor, value) {
+				http.Error(writer, "no such ban", http.StatusNotFound)
+				return
+			}
+			writer.WriteHeader(http.StatusNoContent)
+		default:
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
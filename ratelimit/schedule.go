@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// how often the schedules are checked, they switch at minute boundaries or at their from and to times.
+const scheduleInterval = time.Second
+
+// RunSchedules switches the limits of the buckets when the active schedules change, the buckets keep
+// their state.
+func (s *Service) RunSchedules(ctx context.Context) error {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			s.switchSchedules(now)
+			s.switchGauge(now)
+		}
+	}
+}
+
+func (s *Service) switchSchedules(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	conf, _ := s.config.Load().(*config.Config)
+	if conf == nil {
+		return
+	}
+	active := conf.ActiveSchedules(now)
+	if reflect.DeepEqual(active, s.schedules) {
+		return
+	}
+	log.Info().Msgf("active schedules: %v", active)
+	s.schedules = active
+	s.limiter.Update(conf.KeyLimitsAt(now))
+}
+
+// Schedules returns the name of the active schedule per full key.
+func (s *Service) Schedules() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.schedules
+}
+
+// SchedulesHandler serves the active schedules.
+func SchedulesHandler(s *Service) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(s.Schedules())
+	})
+}
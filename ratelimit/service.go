@@ -1,7 +1,9 @@
 package ratelimit
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/istio-conductor/shard-ratelimit/bucket"
 	"github.com/istio-conductor/shard-ratelimit/config"
@@ -9,51 +11,312 @@ import (
 	log "github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"reflect"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Backend decides the statuses of the descriptors of a request.
+type Backend interface {
+	DoLimit(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus
+}
+
 type Service struct {
 	config       atomic.Value
 	limiter      *bucket.Buckets
+	backends     map[string]Backend
 	mutex        sync.Mutex
-	replicas     int32
+	topology     config.Topology
 	fileContents map[string][]byte
+	sources      map[string]map[string][]byte
+	countDemand  bool
+	demand       sync.Map
+	strict       bool
+	lastGood     map[string][]byte
+	status       []FileStatus
+	schedules    map[string]string
+	overrides    []config.Override
+	switches     atomic.Value
+	// denyUnknown answers OVER_LIMIT to the domains missing from the config.
+	denyUnknown  bool
+	defaultLimit *config.Limit
+	penalties    *bucket.Penalties
+	// loadedYaml and loadedTopology are those of the config in use when all its files loaded, a change
+	// of the value tables alone builds them on top of it.
+	loadedYaml     map[string][]byte
+	loadedTopology config.Topology
+	// tables are the parsed value tables of the config in use and of its last known good files.
+	tables *config.TableCache
 }
 
 func (s *Service) OnReplicasUpdate(replicas int32) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.replicas = replicas
+	s.topology.Replicas = replicas
+	s.reload()
+}
+
+// OnTopologyUpdate sets the replicas along with their zones.
+func (s *Service) OnTopologyUpdate(topology config.Topology) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	topology.Demand = s.topology.Demand
+	s.topology = topology
 	s.reload()
 }
 
+// OnDemandUpdate sets the observed share of the hits per domain and zone.
+func (s *Service) OnDemandUpdate(demand map[string]map[string]float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.topology.Demand = demand
+	s.reload()
+}
+
+func (s *Service) Replicas() int32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.topology.Replicas
+}
+
+// WithDemand makes the service count the hits per domain for Demand.
+func (s *Service) WithDemand() *Service {
+	s.countDemand = true
+	return s
+}
+
+// Demand returns the hits per domain since start.
+func (s *Service) Demand() map[string]int64 {
+	m := map[string]int64{}
+	s.demand.Range(func(key, value interface{}) bool {
+		m[key.(string)] = atomic.LoadInt64(value.(*int64))
+		return true
+	})
+	return m
+}
+
+func (s *Service) hit(domain string) {
+	counter, ok := s.demand.Load(domain)
+	if !ok {
+		counter, _ = s.demand.LoadOrStore(domain, new(int64))
+	}
+	atomic.AddInt64(counter.(*int64), 1)
+}
+
 func (s *Service) OnConfigUpdate(fileContents map[string][]byte) {
+	s.OnSourceUpdate("", fileContents)
+}
+
+// OnSourceUpdate sets the files of one of several config sources, the files of all
+// sources are loaded together.
+func (s *Service) OnSourceUpdate(source string, fileContents map[string][]byte) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.fileContents = fileContents
+	s.sources[source] = fileContents
+	s.fileContents = map[string][]byte{}
+	for _, files := range s.sources {
+		for name, content := range files {
+			s.fileContents[name] = content
+		}
+	}
 	s.reload()
 }
 
+// Source returns the loader of the files of a config source.
+func (s *Service) Source(source string) func(fileContents map[string][]byte) {
+	return func(fileContents map[string][]byte) {
+		s.OnSourceUpdate(source, fileContents)
+	}
+}
+
 func (s *Service) reload() {
-	var files []config.File
-	for name, bytes := range s.fileContents {
-		files = append(files, config.File{Name: name, Content: bytes})
+	files := sortedFiles(s.fileContents)
+	newConfig, errs := s.load(files)
+	failed := fileErrors(errs)
+	for _, err := range errs {
+		log.Error().Err(err).Msg("load config failed")
 	}
 
-	newConfig, err := config.New(s.replicas, files)
-	if err != nil {
+	// the content in use per file, keeping the last known good files of the domains with failed files,
+	// or all of them in strict mode.
+	inUse := map[string][]byte{}
+	switch {
+	case len(failed) == 0:
+		for _, file := range files {
+			inUse[file.Name] = file.Content
+		}
+	case s.strict && s.lastGood != nil:
+		inUse = s.lastGood
+	default:
+		inUse = s.keepDomains(files, failed, newConfig.FailedDomains())
+	}
+	var rebuilt map[string][]error
+	if len(failed) > 0 {
 		prom.ConfigLoadError.Inc()
-		log.Error().Err(err).Msg("load config failed")
-		return
+		var rebuildErrs []error
+		newConfig, rebuildErrs = config.Load(s.topology, sortedFiles(inUse), s.tables)
+		for _, err := range rebuildErrs {
+			log.Error().Err(err).Msg("load last known good config failed")
+		}
+		rebuilt = fileErrors(rebuildErrs)
+		for name := range rebuilt {
+			delete(inUse, name)
+		}
+	} else {
+		prom.ConfigLoadSuccess.Inc()
+	}
+
+	now := time.Now()
+	status := make([]FileStatus, 0, len(files))
+	for _, file := range files {
+		st := FileStatus{Name: file.Name, Hash: hash(file.Content), OK: true, LoadedAt: now}
+		fileErrs := append(append([]error(nil), failed[file.Name]...), rebuilt[file.Name]...)
+		if len(fileErrs) > 0 {
+			st.OK = false
+			st.Error = config.Errors(fileErrs).Error()
+		}
+		content, ok := inUse[file.Name]
+		switch {
+		case !ok:
+			st.Unused = true
+		case !bytes.Equal(content, file.Content):
+			st.LastGood = true
+			st.LastGoodHash = hash(content)
+		}
+		status = append(status, st)
+	}
+	s.lastGood = inUse
+	s.tables.Prune(s.fileContents, inUse)
+	s.updateStatus(status)
+
+	if s.defaultLimit != nil {
+		if err := newConfig.SetDefaultLimit(s.defaultLimit); err != nil {
+			log.Error().Err(err).Msg("default limit not applied")
+		}
+	}
+	for _, err := range newConfig.ApplyOverrides(s.overrides) {
+		log.Warn().Err(err).Msg("override not applied")
+	}
+	for _, warning := range newConfig.Warnings() {
+		log.Warn().Err(warning).Msg("limit enforced loosely")
 	}
-	prom.ConfigLoadSuccess.Inc()
+	s.checkBackends(newConfig)
 	s.config.Store(newConfig)
-	limits := newConfig.KeyLimits()
+	s.schedules = newConfig.ActiveSchedules(now)
+	limits := newConfig.KeyLimitsAt(now)
 	log.Info().Msgf("key limits: %v", limits)
 	s.limiter.Update(limits)
 }
 
+// load loads the files, only building the changed value tables when the yaml files and the topology are
+// those of the config in use.
+func (s *Service) load(files []config.File) (*config.Config, []error) {
+	yamlFiles, tableFiles := map[string][]byte{}, map[string][]byte{}
+	for _, file := range files {
+		if config.IsTable(file.Name) {
+			tableFiles[file.Name] = file.Content
+		} else {
+			yamlFiles[file.Name] = file.Content
+		}
+	}
+	current, _ := s.config.Load().(*config.Config)
+	if current != nil && s.loadedYaml != nil && reflect.DeepEqual(yamlFiles, s.loadedYaml) && reflect.DeepEqual(s.topology, s.loadedTopology) {
+		if c, errs := current.WithTables(tableFiles); len(errs) == 0 {
+			return c, nil
+		}
+	}
+	c, errs := config.Load(s.topology, files, s.tables)
+	s.loadedYaml = nil
+	if len(errs) == 0 {
+		s.loadedYaml = yamlFiles
+		s.loadedTopology = s.topology
+	}
+	return c, errs
+}
+
+// keepDomains returns the files in use when some failed to load: the domains with failed files keep their
+// last known good files, the other domains and the tables which loaded take the new files.
+func (s *Service) keepDomains(files []config.File, failed map[string][]error, domains map[string]bool) map[string][]byte {
+	for name := range failed {
+		if domain := config.FileDomain(s.lastGood[name]); domain != "" {
+			domains[domain] = true
+		}
+	}
+	inUse := map[string][]byte{}
+	for name, content := range s.lastGood {
+		if !config.IsTable(name) && domains[config.FileDomain(content)] {
+			inUse[name] = content
+		}
+	}
+	for _, file := range files {
+		if _, bad := failed[file.Name]; bad {
+			if content, ok := s.lastGood[file.Name]; ok && config.IsTable(file.Name) {
+				inUse[file.Name] = content
+			}
+			continue
+		}
+		if !config.IsTable(file.Name) && domains[config.FileDomain(file.Content)] {
+			continue
+		}
+		inUse[file.Name] = file.Content
+	}
+	return inUse
+}
+
+// OnOverrides sets the runtime overrides applied on top of the config.
+func (s *Service) OnOverrides(overrides []config.Override) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if reflect.DeepEqual(overrides, s.overrides) {
+		return
+	}
+	s.overrides = overrides
+	s.reload()
+}
+
+// CheckOverride reports whether the override applies to the current config.
+func (s *Service) CheckOverride(o *config.Override) error {
+	return s.Config().CheckOverride(o)
+}
+
+// WithStrict keeps the whole last known good config when any file fails to load.
+func (s *Service) WithStrict() *Service {
+	s.strict = true
+	return s
+}
+
+// WithUnknownDomain sets the policy of the domains missing from the config, allow or deny.
+func (s *Service) WithUnknownDomain(policy string) error {
+	switch policy {
+	case UnknownDomainAllow:
+		s.denyUnknown = false
+	case UnknownDomainDeny:
+		s.denyUnknown = true
+	default:
+		return ErrUnknownDomainPolicy
+	}
+	return nil
+}
+
+// WithDefaultLimit limits the descriptors without a limit of the domains without default_descriptor,
+// with a limit like 100/second or 100/10s.
+func (s *Service) WithDefaultLimit(limit string) error {
+	defaultLimit, err := config.ParseLimit(limit)
+	if err != nil {
+		return err
+	}
+	s.defaultLimit = defaultLimit
+	return nil
+}
+
+const (
+	UnknownDomainAllow = "allow"
+	UnknownDomainDeny  = "deny"
+)
+
+var ErrUnknownDomainPolicy = errors.New("unknown domain policy must be allow or deny")
+
 var (
 	ErrEmptyDomain      = status.Error(codes.InvalidArgument, "rate limit domain must not be empty")
 	ErrEmptyDescriptors = status.Error(codes.InvalidArgument, "rate limit descriptor list must not be empty")
@@ -79,21 +342,61 @@ func (s *Service) shouldRateLimit(
 	if conf == nil {
 		return nil, ErrNoConfiguration
 	}
+	if s.countDemand && conf.HasDomain(request.Domain) {
+		s.hit(request.Domain)
+	}
+
+	forced, all := s.forced(request)
+	if all {
+		return response(forced), nil
+	}
+	if s.denyUnknown && !conf.HasDomain(request.Domain) {
+		log.Debug().Msgf("unknown domain '%s' denied", request.Domain)
+		prom.UnknownDomainDenied.Inc()
+		statuses := make([]*pb.RateLimitResponse_DescriptorStatus, len(request.Descriptors))
+		for i := range statuses {
+			statuses[i] = bucket.FAIL
+			if forced != nil && forced[i] != nil {
+				statuses[i] = forced[i]
+			}
+		}
+		return response(statuses), nil
+	}
 
 	limitsToCheck := make([]*config.RateLimit, len(request.Descriptors))
+	now := time.Now()
 
 	for i, descriptor := range request.Descriptors {
+		if forced != nil && forced[i] != nil {
+			continue
+		}
 		limit, err := conf.GetLimit(ctx, request.Domain, descriptor)
 		if err != nil {
 			return nil, err
 		}
 		log.Debug().Msgf("descriptor: %s", entries(descriptor.GetEntries()))
+		if s.banned(limit, descriptor, now) {
+			if forced == nil {
+				forced = make([]*pb.RateLimitResponse_DescriptorStatus, len(request.Descriptors))
+			}
+			forced[i] = bucket.FAIL
+			continue
+		}
 		limitsToCheck[i] = limit
 		log.Debug().Msgf("limit: %s", (*config.DebugLimit)(limit))
 	}
 
-	statuses := s.limiter.DoLimit(ctx, request, limitsToCheck)
+	statuses := s.backend(conf.Backend(request.Domain)).DoLimit(ctx, request, limitsToCheck)
+	s.violations(request, limitsToCheck, statuses, now)
+	for i, status := range forced {
+		if status != nil {
+			statuses[i] = status
+		}
+	}
+	return response(statuses), nil
+}
 
+func response(statuses []*pb.RateLimitResponse_DescriptorStatus) *pb.RateLimitResponse {
 	response := &pb.RateLimitResponse{
 		Statuses:    statuses,
 		OverallCode: pb.RateLimitResponse_OK,
@@ -103,7 +406,7 @@ func (s *Service) shouldRateLimit(
 			response.OverallCode = s.Code
 		}
 	}
-	return response, nil
+	return response
 }
 
 func (s *Service) ShouldRateLimit(
@@ -114,12 +417,38 @@ func (s *Service) ShouldRateLimit(
 	return response, err
 }
 
+// WithBackend registers a backend which domains can select by name.
+func (s *Service) WithBackend(name string, backend Backend) *Service {
+	s.backends[name] = backend
+	return s
+}
+
+func (s *Service) backend(name string) Backend {
+	if backend, ok := s.backends[name]; ok {
+		return backend
+	}
+	return s.limiter
+}
+
+// checkBackends warns once per load about the domains selecting a backend which is not configured.
+func (s *Service) checkBackends(conf *config.Config) {
+	for domain, name := range conf.Backends() {
+		if _, ok := s.backends[name]; !ok && name != config.BackendLocal {
+			log.Warn().Msgf("backend %s of domain %s is not configured, using local buckets", name, domain)
+		}
+	}
+}
+
 func (s *Service) Config() *config.Config {
 	return s.config.Load().(*config.Config)
 }
 
 func New(limiter *bucket.Buckets) *Service {
 	return &Service{
-		limiter: limiter,
+		limiter:   limiter,
+		tables:    config.NewTableCache(),
+		backends:  map[string]Backend{},
+		sources:   map[string]map[string][]byte{},
+		penalties: bucket.NewPenalties(bucket.DefaultPenaltyEntries),
 	}
 }
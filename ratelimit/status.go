@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// FileStatus is the result of loading a config file.
+type FileStatus struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// LastGood is set when the last known good content of the file is used instead.
+	LastGood     bool   `json:"last_good"`
+	LastGoodHash string `json:"last_good_hash,omitempty"`
+	// Unused is set when the file is left out, its domain keeps the last known good config without it.
+	Unused   bool      `json:"unused,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+func hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func sortedFiles(contents map[string][]byte) []config.File {
+	files := make([]config.File, 0, len(contents))
+	for name, content := range contents {
+		files = append(files, config.File{Name: name, Content: content})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// fileErrors groups the errors of a load by file.
+func fileErrors(errs []error) map[string][]error {
+	m := map[string][]error{}
+	for _, err := range errs {
+		var e *config.Error
+		if errors.As(err, &e) {
+			m[e.File] = append(m[e.File], err)
+		}
+	}
+	return m
+}
+
+// FileStatus returns the load status of the config files.
+func (s *Service) FileStatus() []FileStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]FileStatus(nil), s.status...)
+}
+
+func (s *Service) updateStatus(status []FileStatus) {
+	for _, previous := range s.status {
+		prom.ConfigFileStatus.DeleteLabelValues(previous.Name)
+	}
+	for _, st := range status {
+		value := 0.0
+		if st.OK {
+			value = 1
+		}
+		prom.ConfigFileStatus.WithLabelValues(st.Name).Set(value)
+	}
+	s.status = status
+}
+
+// StatusHandler serves the load status of the config files.
+func StatusHandler(s *Service) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(s.FileStatus())
+	})
+}
+
+// StatusSummaryHandler serves only whether each config file loaded, without the errors which may quote the
+// files, for when the admin API is disabled.
+func StatusSummaryHandler(s *Service) http.Handler {
+	type summary struct {
+		Name string `json:"name"`
+		OK   bool   `json:"ok"`
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		status := s.FileStatus()
+		summaries := make([]summary, 0, len(status))
+		for _, st := range status {
+			summaries = append(summaries, summary{Name: st.Name, OK: st.OK})
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(summaries)
+	})
+}
+
+// Loaded tells whether a config file loaded, whether its last known good content is used instead,
+// and the error when it did not load.
+func (s *Service) Loaded(name string) (ok bool, lastGood bool, message string) {
+	for _, st := range s.FileStatus() {
+		if st.Name == name {
+			return st.OK, st.LastGood, st.Error
+		}
+	}
+	return false, false, "not loaded"
+}
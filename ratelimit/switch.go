@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/bucket"
+	"github.com/istio-conductor/shard-ratelimit/override"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"time"
+)
+
+// OnSwitches sets the kill switches, which force the statuses before any limit is checked.
+func (s *Service) OnSwitches(switches []override.Switch) {
+	byDomain := map[string][]override.Switch{}
+	for _, sw := range switches {
+		byDomain[sw.Domain] = append(byDomain[sw.Domain], sw)
+	}
+	s.switches.Store(byDomain)
+	s.switchGauge(time.Now())
+}
+
+func (s *Service) domainSwitches(domain string) []override.Switch {
+	byDomain, _ := s.switches.Load().(map[string][]override.Switch)
+	return byDomain[domain]
+}
+
+// switchGauge exports the active switches.
+func (s *Service) switchGauge(now time.Time) {
+	byDomain, _ := s.switches.Load().(map[string][]override.Switch)
+	prom.KillSwitch.Reset()
+	for _, switches := range byDomain {
+		for i := range switches {
+			if switches[i].Active(now) {
+				prom.KillSwitch.WithLabelValues(switches[i].Domain, switches[i].Subtree(), switches[i].Mode).Set(1)
+			}
+		}
+	}
+}
+
+// forced returns the statuses forced by the switches of the domain, nil for the descriptors they don't
+// match, and whether all the descriptors are forced.
+func (s *Service) forced(request *pb.RateLimitRequest) ([]*pb.RateLimitResponse_DescriptorStatus, bool) {
+	switches := s.domainSwitches(request.Domain)
+	if len(switches) == 0 {
+		return nil, false
+	}
+	now := time.Now()
+	statuses := make([]*pb.RateLimitResponse_DescriptorStatus, len(request.Descriptors))
+	all := true
+	for i, descriptor := range request.Descriptors {
+		for j := range switches {
+			sw := &switches[j]
+			if !sw.Active(now) || !sw.Matches(descriptor.Entries) {
+				continue
+			}
+			prom.KillSwitchHits.WithLabelValues(request.Domain, sw.Mode).Inc()
+			if sw.Mode == override.ModeDeny {
+				statuses[i] = bucket.FAIL
+			} else {
+				statuses[i] = bucket.OK
+			}
+			break
+		}
+		if statuses[i] == nil {
+			all = false
+		}
+	}
+	return statuses, all
+}
@@ -0,0 +1,101 @@
+package reconcile
+
+import (
+	"context"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"github.com/rs/zerolog/log"
+	"math"
+	"time"
+)
+
+// Buckets are the local shards which are reconciled.
+type Buckets interface {
+	Consumed() map[string]int64
+	Rate(key string) float64
+	Penalize(key string, n int)
+}
+
+// Store shares the consumption of the replicas.
+type Store interface {
+	// Report adds the local consumption to window.
+	Report(ctx context.Context, window int64, used map[string]int64) error
+	// Totals returns the consumption of window summed over all replicas.
+	Totals(ctx context.Context, window int64, keys []string) (map[string]int64, error)
+}
+
+// Reconciler lets the replicas decide locally, then periodically reports the consumed tokens and
+// takes the over-consumption of the whole cluster in an interval from the next interval's allowance.
+type Reconciler struct {
+	buckets  Buckets
+	store    Store
+	replicas func() int32
+	interval time.Duration
+	settle   time.Duration
+}
+
+func New(buckets Buckets, store Store, replicas func() int32, interval time.Duration) *Reconciler {
+	return &Reconciler{
+		buckets:  buckets,
+		store:    store,
+		replicas: replicas,
+		interval: interval,
+		settle:   interval / 5,
+	}
+}
+
+// Run reconciles at the boundaries of the windows, so every replica reports the same span of time for a window.
+func (r *Reconciler) Run(ctx context.Context) error {
+	interval := int64(r.interval)
+	for {
+		next := time.Now().UnixNano()/interval + 1
+		timer := time.NewTimer(time.Until(time.Unix(0, next*interval)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			err := r.reconcile(ctx, next-1)
+			if err != nil {
+				prom.ReconcileError.Inc()
+				log.Error().Err(err).Msg("reconcile failed")
+			}
+		}
+	}
+}
+
+func (r *Reconciler) reconcile(ctx context.Context, window int64) error {
+	used := r.buckets.Consumed()
+	if err := r.store.Report(ctx, window, used); err != nil {
+		return err
+	}
+	// give the other replicas a moment to report the same window.
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.settle):
+	}
+	keys := make([]string, 0, len(used))
+	for key := range used {
+		keys = append(keys, key)
+	}
+	totals, err := r.store.Totals(ctx, window, keys)
+	if err != nil {
+		return err
+	}
+	replicas := float64(r.replicas())
+	if replicas < 1 {
+		replicas = 1
+	}
+	for key, total := range totals {
+		allowed := r.buckets.Rate(key) * r.interval.Seconds()
+		excess := float64(total)/replicas - allowed
+		if excess < 1 {
+			continue
+		}
+		// never take more than one interval of allowance.
+		n := int(math.Ceil(math.Min(excess, allowed)))
+		prom.ReconcilePenalty.Add(float64(n))
+		r.buckets.Penalize(key, n)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/istio-conductor/shard-ratelimit/replicas"
+	"github.com/mediocregopher/radix/v3"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const Path = "/reconcile"
+
+// keep a few windows around for the peers which are late.
+const keepWindows = 4
+
+// Peers exchanges the consumption with the other replicas over http.
+type Peers struct {
+	self    string
+	port    int
+	members func() []string
+	client  *http.Client
+	token   string
+
+	mu      sync.Mutex
+	reports map[int64]map[string]int64
+}
+
+func NewPeers(self string, port int, members func() []string, timeout time.Duration) *Peers {
+	return &Peers{
+		self:    self,
+		port:    port,
+		members: members,
+		client:  &http.Client{Timeout: timeout},
+		reports: map[int64]map[string]int64{},
+	}
+}
+
+// WithToken authenticates the requests to the peers with the shared token of the replicas.
+func (p *Peers) WithToken(token string) *Peers {
+	p.token = token
+	return p
+}
+
+func (p *Peers) Report(_ context.Context, window int64, used map[string]int64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	report := p.reports[window]
+	if report == nil {
+		report = map[string]int64{}
+		p.reports[window] = report
+	}
+	for key, n := range used {
+		report[key] += n
+	}
+	for w := range p.reports {
+		if w <= window-keepWindows {
+			delete(p.reports, w)
+		}
+	}
+	return nil
+}
+
+func (p *Peers) report(window int64) map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reports[window]
+}
+
+func (p *Peers) Totals(ctx context.Context, window int64, keys []string) (map[string]int64, error) {
+	totals := map[string]int64{}
+	for key, n := range p.report(window) {
+		totals[key] += n
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, member := range p.members() {
+		if member == p.self {
+			continue
+		}
+		wg.Add(1)
+		go func(member string) {
+			defer wg.Done()
+			used, err := p.fetch(ctx, member, window)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			for _, key := range keys {
+				totals[key] += used[key]
+			}
+			mu.Unlock()
+		}(member)
+	}
+	wg.Wait()
+	return totals, nil
+}
+
+func (p *Peers) fetch(ctx context.Context, member string, window int64) (map[string]int64, error) {
+	query := url.Values{"window": {strconv.FormatInt(window, 10)}}
+	u := "http://" + net.JoinHostPort(member, strconv.Itoa(p.port)) + Path + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	replicas.Authorize(req, p.token)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", member, resp.Status)
+	}
+	used := map[string]int64{}
+	err = json.NewDecoder(resp.Body).Decode(&used)
+	return used, err
+}
+
+// ServeHTTP serves the local consumption of a window to the peers.
+func (p *Peers) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	window, err := strconv.ParseInt(request.URL.Query().Get("window"), 10, 64)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	used := p.report(window)
+	if used == nil {
+		used = map[string]int64{}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(used)
+}
+
+// Redis sums the consumption of the replicas in redis.
+type Redis struct {
+	client radix.Client
+	prefix string
+	expire time.Duration
+}
+
+func NewRedis(client radix.Client, prefix string, interval time.Duration) *Redis {
+	return &Redis{client: client, prefix: prefix + "reconcile_", expire: interval * keepWindows}
+}
+
+func (r *Redis) key(key string, window int64) string {
+	return r.prefix + key + "_" + strconv.FormatInt(window, 10)
+}
+
+func (r *Redis) Report(_ context.Context, window int64, used map[string]int64) error {
+	if len(used) == 0 {
+		return nil
+	}
+	cmds := make([]radix.CmdAction, 0, len(used)*2)
+	expire := int64(r.expire.Seconds()) + 1
+	for key, n := range used {
+		cmds = append(cmds,
+			radix.FlatCmd(nil, "INCRBY", r.key(key, window), n),
+			radix.FlatCmd(nil, "EXPIRE", r.key(key, window), expire))
+	}
+	return r.client.Do(radix.Pipeline(cmds...))
+}
+
+func (r *Redis) Totals(_ context.Context, window int64, keys []string) (map[string]int64, error) {
+	if len(keys) == 0 {
+		return map[string]int64{}, nil
+	}
+	args := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = r.key(key, window)
+	}
+	values := make([]int64, len(keys))
+	if err := r.client.Do(radix.Cmd(&values, "MGET", args...)); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64, len(keys))
+	for i, key := range keys {
+		totals[key] = values[i]
+	}
+	return totals, nil
+}
@@ -0,0 +1,150 @@
+package redis
+
+import (
+	"context"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/bucket"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"github.com/mediocregopher/radix/v3"
+	"github.com/mediocregopher/radix/v3/trace"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache keeps fixed window counters in redis with the key scheme of envoy's ratelimit,
+// falling back to the local buckets when redis is not available.
+type Cache struct {
+	client          radix.Client
+	perSecondClient radix.Client
+	prefix          string
+	fallback        *bucket.Buckets
+	now             func() time.Time
+}
+
+func poolTrace(stat prom.PoolStat) trace.PoolTrace {
+	return trace.PoolTrace{
+		ConnCreated: func(created trace.PoolConnCreated) {
+			if created.Err == nil {
+				stat.Total.Inc()
+				stat.Active.Inc()
+			}
+		},
+		ConnClosed: func(closed trace.PoolConnClosed) {
+			stat.Close.Inc()
+			stat.Active.Dec()
+		},
+	}
+}
+
+// NewPool connects a pool to the redis at url, which is either host:port or a redis:// url.
+func NewPool(url string, size int, stat prom.PoolStat) (radix.Client, error) {
+	return radix.NewPool("tcp", url, size, radix.PoolWithTrace(poolTrace(stat)))
+}
+
+func New(client radix.Client, perSecondClient radix.Client, prefix string, fallback *bucket.Buckets) *Cache {
+	return &Cache{
+		client:          client,
+		perSecondClient: perSecondClient,
+		prefix:          prefix,
+		fallback:        fallback,
+		now:             time.Now,
+	}
+}
+
+// intervalToDivider returns the window of the limit in seconds.
+func intervalToDivider(interval time.Duration) int64 {
+	if divider := int64(interval / time.Second); divider > 0 {
+		return divider
+	}
+	return 1
+}
+
+// cacheKey generates the same key as envoy's ratelimit: prefix + domain_key_value_..._windowStart.
+func (c *Cache) cacheKey(domain string, descriptor *pb_struct.RateLimitDescriptor, divider int64, now int64) string {
+	var b strings.Builder
+	b.WriteString(c.prefix)
+	b.WriteString(domain)
+	b.WriteByte('_')
+	for _, entry := range descriptor.Entries {
+		b.WriteString(entry.Key)
+		b.WriteByte('_')
+		b.WriteString(entry.Value)
+		b.WriteByte('_')
+	}
+	b.WriteString(strconv.FormatInt((now/divider)*divider, 10))
+	return b.String()
+}
+
+func (c *Cache) DoLimit(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit) []*pb.RateLimitResponse_DescriptorStatus {
+	now := c.now().Unix()
+	results := make([]uint32, len(limits))
+	var pipeline, perSecondPipeline []radix.CmdAction
+	for i, limit := range limits {
+		if limit == nil || limit.Access != "" {
+			continue
+		}
+		divider := intervalToDivider(limit.Interval)
+		key := c.cacheKey(request.Domain, request.Descriptors[i], divider, now)
+		cmds := []radix.CmdAction{
+			radix.FlatCmd(&results[i], "INCRBY", key, limit.Consumption(request.Descriptors[i], request.HitsAddend)),
+			radix.FlatCmd(nil, "EXPIRE", key, divider),
+		}
+		if c.perSecondClient != nil && limit.Interval == time.Second {
+			perSecondPipeline = append(perSecondPipeline, cmds...)
+		} else {
+			pipeline = append(pipeline, cmds...)
+		}
+	}
+	if err := c.do(c.client, pipeline); err != nil {
+		return c.fail(ctx, request, limits, err)
+	}
+	if err := c.do(c.perSecondClient, perSecondPipeline); err != nil {
+		return c.fail(ctx, request, limits, err)
+	}
+
+	resp := make([]*pb.RateLimitResponse_DescriptorStatus, 0, len(limits))
+	for i, limit := range limits {
+		if limit == nil {
+			resp = append(resp, bucket.UNKNOWN)
+			continue
+		}
+		if status := bucket.Listed(request.Domain, limit); status != nil {
+			resp = append(resp, status)
+			continue
+		}
+		divider := intervalToDivider(limit.Interval)
+		status := &pb.RateLimitResponse_DescriptorStatus{
+			Code: pb.RateLimitResponse_OK,
+			CurrentLimit: &pb.RateLimitResponse_RateLimit{
+				RequestsPerUnit: limit.RequestsPerUnit,
+				Unit:            limit.Limit.Unit,
+			},
+			DurationUntilReset: durationpb.New(time.Duration(divider-now%divider) * time.Second),
+		}
+		if results[i] > limit.RequestsPerUnit {
+			status.Code = pb.RateLimitResponse_OVER_LIMIT
+		} else {
+			status.LimitRemaining = limit.RequestsPerUnit - results[i]
+		}
+		resp = append(resp, status)
+	}
+	return resp
+}
+
+func (c *Cache) do(client radix.Client, pipeline []radix.CmdAction) error {
+	if len(pipeline) == 0 {
+		return nil
+	}
+	return client.Do(radix.Pipeline(pipeline...))
+}
+
+func (c *Cache) fail(ctx context.Context, request *pb.RateLimitRequest, limits []*config.RateLimit, err error) []*pb.RateLimitResponse_DescriptorStatus {
+	prom.RedisError.Inc()
+	log.Error().Err(err).Msg("redis failed, fallback to local buckets")
+	return c.fallback.DoLimit(ctx, request, limits)
+}
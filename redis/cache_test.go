@@ -0,0 +1,121 @@
+package redis
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	pb_struct "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	pb "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/bucket"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/mediocregopher/radix/v3"
+	"testing"
+	"time"
+)
+
+// the start of a minute plus 5 seconds.
+var testNow = time.Unix(1200+5, 0)
+
+func newTestCache(t *testing.T) (*Cache, *miniredis.Miniredis, *bucket.Buckets) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	client, err := radix.NewPool("tcp", server.Addr(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+	fallback := bucket.New()
+	c := New(client, nil, "rl_", fallback)
+	c.now = func() time.Time { return testNow }
+	return c, server, fallback
+}
+
+func request(hits uint32) *pb.RateLimitRequest {
+	return &pb.RateLimitRequest{
+		Domain:      "d",
+		HitsAddend:  hits,
+		Descriptors: []*pb_struct.RateLimitDescriptor{{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "k", Value: "v"}}}},
+	}
+}
+
+func minuteLimit(requests uint32) []*config.RateLimit {
+	return []*config.RateLimit{config.NewRateLimit(requests, pb.RateLimitResponse_RateLimit_MINUTE, "d.k")}
+}
+
+func TestCacheKey(t *testing.T) {
+	c := &Cache{prefix: "rl_"}
+	descriptor := &pb_struct.RateLimitDescriptor{Entries: []*pb_struct.RateLimitDescriptor_Entry{{Key: "k", Value: "v"}, {Key: "x", Value: "y"}}}
+	tests := []struct {
+		divider int64
+		want    string
+	}{
+		{1, "rl_d_k_v_x_y_1205"},
+		{60, "rl_d_k_v_x_y_1200"},
+		{3600, "rl_d_k_v_x_y_0"},
+	}
+	for _, test := range tests {
+		if got := c.cacheKey("d", descriptor, test.divider, testNow.Unix()); got != test.want {
+			t.Errorf("cacheKey with divider %d = %q, want %q", test.divider, got, test.want)
+		}
+	}
+}
+
+func TestDoLimitIncrByAndExpire(t *testing.T) {
+	c, server, _ := newTestCache(t)
+	c.DoLimit(context.Background(), request(3), minuteLimit(10))
+
+	key := "rl_d_k_v_1200"
+	got, err := server.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "3" {
+		t.Errorf("counter = %s, want 3", got)
+	}
+	if ttl := server.TTL(key); ttl != time.Minute {
+		t.Errorf("ttl = %s, want %s", ttl, time.Minute)
+	}
+}
+
+func TestDoLimitOverLimit(t *testing.T) {
+	c, _, _ := newTestCache(t)
+	limits := minuteLimit(2)
+	wants := []struct {
+		code      pb.RateLimitResponse_Code
+		remaining uint32
+	}{
+		{pb.RateLimitResponse_OK, 1},
+		{pb.RateLimitResponse_OK, 0},
+		{pb.RateLimitResponse_OVER_LIMIT, 0},
+	}
+	for i, want := range wants {
+		status := c.DoLimit(context.Background(), request(0), limits)[0]
+		if status.Code != want.code || status.LimitRemaining != want.remaining {
+			t.Errorf("hit %d: code %s remaining %d, want %s remaining %d", i, status.Code, status.LimitRemaining, want.code, want.remaining)
+		}
+		if reset := status.DurationUntilReset.AsDuration(); reset != 55*time.Second {
+			t.Errorf("hit %d: reset in %s, want 55s", i, reset)
+		}
+	}
+}
+
+func TestDoLimitFallback(t *testing.T) {
+	c, server, fallback := newTestCache(t)
+	fallback.Update(map[string]config.KeyLimit{"d.k": {Rate: 0.001, Burst: 1}})
+	server.Close()
+
+	limits := minuteLimit(10)
+	wants := []pb.RateLimitResponse_Code{pb.RateLimitResponse_OK, pb.RateLimitResponse_OVER_LIMIT}
+	for i, want := range wants {
+		status := c.DoLimit(context.Background(), request(0), limits)[0]
+		if status.Code != want {
+			t.Errorf("hit %d: code %s, want %s from the fallback", i, status.Code, want)
+		}
+		if status.CurrentLimit != nil {
+			t.Errorf("hit %d: current limit %v, want none from the fallback", i, status.CurrentLimit)
+		}
+	}
+}
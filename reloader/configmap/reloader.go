@@ -2,25 +2,63 @@ package configmap
 
 import (
 	"context"
+	"errors"
+	"github.com/istio-conductor/shard-ratelimit/prom"
+	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"reflect"
 	"sync"
 	"time"
 )
 import "sigs.k8s.io/controller-runtime/pkg/client/config"
 
+var ErrUnknownPolicy = errors.New("unknown configmap absence policy")
+
+// Policy is what to do when the watched configmap is deleted or doesn't exist.
+type Policy string
+
+const (
+	// PolicyKeep keeps serving the last loaded config.
+	PolicyKeep Policy = "keep"
+	// PolicyClear loads an empty config, removing all the limits.
+	PolicyClear Policy = "clear"
+	// PolicyNotReady keeps the last loaded config and marks the pod not ready until the configmap is back.
+	PolicyNotReady Policy = "notready"
+)
+
+func (p Policy) Valid() bool {
+	switch p {
+	case PolicyKeep, PolicyClear, PolicyNotReady:
+		return true
+	}
+	return false
+}
+
 type Dir struct {
 	namespace string
 	name      string
-	kube      kubernetes.Interface
-	load      func(files map[string][]byte)
-	current   map[string][]byte
-	mu        sync.Mutex
+	// selector selects many configmaps instead of the one named name, their files are
+	// named <namespace>/<configmap>/<key>.
+	selector string
+	kube     kubernetes.Interface
+	load     func(files map[string][]byte)
+	current  map[string][]byte
+	selected map[string]map[string][]byte
+	mu       sync.Mutex
+
+	policy   Policy
+	ready    func(ready bool)
+	recorder record.EventRecorder
+	missing  bool
 }
 
 func (d *Dir) LoadOnce() {
@@ -52,8 +90,46 @@ func configMapFiles(cm *corev1.ConfigMap) (files map[string][]byte) {
 	return m
 }
 
+func selectedFiles(selected map[string]map[string][]byte) map[string][]byte {
+	m := map[string][]byte{}
+	for prefix, files := range selected {
+		for fileName, content := range files {
+			m[prefix+"/"+fileName] = content
+		}
+	}
+	return m
+}
+
+func (d *Dir) onSelected(cm *corev1.ConfigMap, deleted bool) {
+	key := cm.Namespace + "/" + cm.Name
+	d.mu.Lock()
+	files := configMapFiles(cm)
+	if deleted {
+		if _, ok := d.selected[key]; !ok {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.selected, key)
+	} else {
+		if reflect.DeepEqual(files, d.selected[key]) {
+			d.mu.Unlock()
+			return
+		}
+		d.selected[key] = files
+	}
+	m := selectedFiles(d.selected)
+	d.current = m
+	d.mu.Unlock()
+	d.load(m)
+}
+
 func (d *Dir) OnAdd(obj interface{}) {
 	if cm, ok := obj.(*corev1.ConfigMap); ok {
+		if d.selector != "" {
+			d.onSelected(cm, false)
+			return
+		}
+		d.present(cm)
 		m := configMapFiles(cm)
 		changed := true
 		d.mu.Lock()
@@ -74,10 +150,78 @@ func (d *Dir) OnUpdate(oldObj, obj interface{}) {
 }
 
 func (d *Dir) OnDelete(obj interface{}) {
-	// ignore
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	if d.selector != "" {
+		d.onSelected(cm, true)
+		return
+	}
+	d.absent("deleted")
+}
+
+func (d *Dir) reference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{Kind: "ConfigMap", APIVersion: "v1", Namespace: d.namespace, Name: d.name}
 }
 
-func New(namespace string, name string, load func(files map[string][]byte)) (r *Dir, err error) {
+// absent applies the policy when the configmap is deleted or doesn't exist.
+func (d *Dir) absent(reason string) {
+	d.mu.Lock()
+	d.missing = true
+	d.mu.Unlock()
+	log.Warn().Msgf("configmap %s/%s %s, policy %s", d.namespace, d.name, reason, d.policy)
+	prom.ConfigMapMissing.WithLabelValues(d.name, string(d.policy)).Set(1)
+	switch d.policy {
+	case PolicyClear:
+		d.mu.Lock()
+		d.current = map[string][]byte{}
+		d.mu.Unlock()
+		d.load(map[string][]byte{})
+		d.event(corev1.EventTypeWarning, "ConfigMapMissing", "configmap %s, all limits cleared", reason)
+	case PolicyNotReady:
+		d.ready(false)
+		d.event(corev1.EventTypeWarning, "ConfigMapMissing", "configmap %s, keeping the last config and not ready", reason)
+	default:
+		d.event(corev1.EventTypeWarning, "ConfigMapMissing", "configmap %s, keeping the last config", reason)
+	}
+}
+
+// present undoes absent when the configmap shows up again.
+func (d *Dir) present(cm *corev1.ConfigMap) {
+	d.mu.Lock()
+	missing := d.missing
+	d.missing = false
+	d.mu.Unlock()
+	if !missing {
+		return
+	}
+	log.Info().Msgf("configmap %s/%s is back", d.namespace, d.name)
+	prom.ConfigMapMissing.WithLabelValues(d.name, string(d.policy)).Set(0)
+	if d.policy == PolicyNotReady {
+		d.ready(true)
+	}
+	d.event(corev1.EventTypeNormal, "ConfigMapRestored", "configmap restored, config reloaded")
+}
+
+func (d *Dir) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if d.recorder != nil {
+		d.recorder.Eventf(d.reference(), eventType, reason, messageFmt, args...)
+	}
+}
+
+// New watches the configmap name in namespace, applying policy when it is deleted or doesn't exist,
+// ready is called for PolicyNotReady.
+func New(namespace string, name string, policy Policy, load func(files map[string][]byte), ready func(ready bool)) (r *Dir, err error) {
+	if policy == "" {
+		policy = PolicyKeep
+	}
+	if !policy.Valid() {
+		return nil, ErrUnknownPolicy
+	}
 	c, err := config.GetConfig()
 	if err != nil {
 		return nil, err
@@ -90,16 +234,63 @@ func New(namespace string, name string, load func(files map[string][]byte)) (r *
 	defer cancel()
 
 	cm, err := k.CoreV1().ConfigMaps(namespace).Get(ctx, name, v1.GetOptions{})
-	if err != nil && !errors.IsNotFound(err) {
+	notFound := apierrors.IsNotFound(err)
+	if err != nil && !notFound {
+		return nil, err
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k.CoreV1().Events(namespace)})
+	d := &Dir{
+		namespace: namespace,
+		name:      name,
+		kube:      k,
+		load:      load,
+		policy:    policy,
+		ready:     ready,
+		recorder:  broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "shard-ratelimit"}),
+	}
+	if notFound {
+		d.current = map[string][]byte{}
+		load(d.current)
+		d.absent("not found")
+		return d, nil
+	}
+	d.current = configMapFiles(cm)
+	load(d.current)
+	return d, nil
+}
+
+// NewSelector watches all the configmaps matching selector in namespace, or in all namespaces when
+// namespace is empty.
+func NewSelector(namespace string, selector string, load func(files map[string][]byte)) (r *Dir, err error) {
+	c, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	k, err := kubernetes.NewForConfig(c)
+	if err != nil {
 		return nil, err
 	}
-	m := configMapFiles(cm)
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+
+	list, err := k.CoreV1().ConfigMaps(namespace).List(ctx, v1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]map[string][]byte{}
+	for i := range list.Items {
+		cm := &list.Items[i]
+		selected[cm.Namespace+"/"+cm.Name] = configMapFiles(cm)
+	}
+	m := selectedFiles(selected)
 	load(m)
 	return &Dir{
 		namespace: namespace,
-		name:      name,
+		selector:  selector,
 		kube:      k,
 		current:   m,
+		selected:  selected,
 		load:      load,
 	}, nil
 }
@@ -107,6 +298,10 @@ func New(namespace string, name string, load func(files map[string][]byte)) (r *
 func (d *Dir) Run(ctx context.Context) error {
 	factory := informers.NewSharedInformerFactoryWithOptions(d.kube, time.Minute*15,
 		informers.WithNamespace(d.namespace), informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			if d.selector != "" {
+				options.LabelSelector = d.selector
+				return
+			}
 			options.FieldSelector = fields.OneTermEqualSelector(v1.ObjectNameField, d.name).String()
 		}))
 	i := factory.Core().V1().ConfigMaps().Informer()
@@ -0,0 +1,311 @@
+package crd
+
+import (
+	"context"
+	"github.com/istio-conductor/shard-ratelimit/apis/v1alpha1"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+import "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+const prefix = "crd/"
+
+// the files are yaml whatever the name of the object, a name ending in .csv or .json would make a value table.
+const suffix = ".yaml"
+
+// Status tells whether the file of an object loaded, and the error when it did not.
+type Status func(name string) (ok bool, lastGood bool, message string)
+
+// Controller watches the RateLimitConfig objects and loads each of them as a config file
+// named crd/<namespace>/<name>.yaml, reporting the result in the status of the object.
+// With leader election only the leader writes the status, the replicas load the same files.
+type Controller struct {
+	namespace string
+	selector  string
+	client    dynamic.Interface
+	kube      kubernetes.Interface
+	load      func(files map[string][]byte)
+	status    Status
+	lock      resourcelock.Interface
+	leading   int32
+
+	mu      sync.Mutex
+	synced  bool
+	current map[string][]byte
+	objects map[string]*unstructured.Unstructured
+}
+
+func New(namespace string, selector string, load func(files map[string][]byte), status Status) (*Controller, error) {
+	c, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	kube, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	controller := NewWithClient(client, namespace, selector, load, status)
+	controller.kube = kube
+	return controller, nil
+}
+
+// WithLeaderElection lets only the holder of the lease name in namespace write the status of the objects.
+func (c *Controller) WithLeaderElection(namespace string, name string, identity string) *Controller {
+	c.lock = &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Client:     c.kube.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	return c
+}
+
+// leads reports whether this replica writes the status.
+func (c *Controller) leads() bool {
+	return c.lock == nil || atomic.LoadInt32(&c.leading) == 1
+}
+
+// NewWithClient creates the controller with a given client, such as a fake one.
+func NewWithClient(client dynamic.Interface, namespace string, selector string, load func(files map[string][]byte), status Status) *Controller {
+	return &Controller{
+		namespace: namespace,
+		selector:  selector,
+		client:    client,
+		load:      load,
+		status:    status,
+		current:   map[string][]byte{},
+		objects:   map[string]*unstructured.Unstructured{},
+	}
+}
+
+func fileName(obj metav1.Object) string {
+	return prefix + obj.GetNamespace() + "/" + obj.GetName() + suffix
+}
+
+// content renders the spec of the object as a config file.
+func content(obj *unstructured.Unstructured) ([]byte, error) {
+	spec, _, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(spec)
+}
+
+func (c *Controller) files() map[string][]byte {
+	m := make(map[string][]byte, len(c.current))
+	for name, bytes := range c.current {
+		m[name] = bytes
+	}
+	return m
+}
+
+func (c *Controller) update(obj interface{}, deleted bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	name := fileName(u)
+	c.mu.Lock()
+	changed := false
+	if deleted {
+		_, changed = c.current[name]
+		delete(c.current, name)
+		delete(c.objects, name)
+	} else {
+		data, err := content(u)
+		if err != nil {
+			log.Error().Err(err).Msgf("render %s failed", name)
+			c.mu.Unlock()
+			return
+		}
+		changed = !reflect.DeepEqual(c.current[name], data)
+		c.current[name] = data
+		c.objects[name] = u
+	}
+	files := c.files()
+	synced := c.synced
+	c.mu.Unlock()
+	if !synced {
+		// the initial objects are loaded at once when the cache is synced.
+		return
+	}
+	if changed {
+		c.load(files)
+	}
+	c.reportAll()
+}
+
+func (c *Controller) OnAdd(obj interface{}) {
+	c.update(obj, false)
+}
+
+func (c *Controller) OnUpdate(oldObj, obj interface{}) {
+	c.update(obj, false)
+}
+
+func (c *Controller) OnDelete(obj interface{}) {
+	c.update(obj, true)
+}
+
+// reportAll updates the status of every object, loading one file may change the result of another.
+func (c *Controller) reportAll() {
+	if !c.leads() {
+		return
+	}
+	c.mu.Lock()
+	objects := make([]*unstructured.Unstructured, 0, len(c.objects))
+	for _, obj := range c.objects {
+		objects = append(objects, obj)
+	}
+	synced := c.synced
+	c.mu.Unlock()
+	if !synced {
+		return
+	}
+	for _, obj := range objects {
+		if err := c.report(obj); err != nil {
+			log.Error().Err(err).Msgf("update status of %s failed", fileName(obj))
+		}
+	}
+}
+
+// report sets the Loaded condition of the object, reading the object again when the status was written meanwhile.
+func (c *Controller) report(obj *unstructured.Unstructured) error {
+	ok, lastGood, message := c.status(fileName(obj))
+	condition := metav1.Condition{
+		Type:               v1alpha1.ConditionLoaded,
+		Status:             metav1.ConditionTrue,
+		Reason:             v1alpha1.ReasonLoaded,
+		Message:            "config loaded",
+		ObservedGeneration: obj.GetGeneration(),
+	}
+	if !ok {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = v1alpha1.ReasonInvalid
+		condition.Message = message
+		if lastGood {
+			condition.Reason = v1alpha1.ReasonLastGood
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*5)
+	defer cancel()
+	resource := c.client.Resource(v1alpha1.GroupVersionResource).Namespace(obj.GetNamespace())
+	current := obj
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if current == nil {
+			latest, err := resource.Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if latest.GetGeneration() != obj.GetGeneration() {
+				// the new generation is reported when its update is seen.
+				return nil
+			}
+			current = latest
+		}
+		u, err := withCondition(current, condition)
+		current = nil
+		if err != nil || u == nil {
+			return err
+		}
+		_, err = resource.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// withCondition returns a copy of obj with the condition in its status, nil when the status has it already.
+func withCondition(obj *unstructured.Unstructured, condition metav1.Condition) (*unstructured.Unstructured, error) {
+	var typed v1alpha1.RateLimitConfig
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &typed); err != nil {
+		return nil, err
+	}
+	existing := meta.FindStatusCondition(typed.Status.Conditions, v1alpha1.ConditionLoaded)
+	if existing != nil && existing.Status == condition.Status && existing.Reason == condition.Reason &&
+		existing.Message == condition.Message && existing.ObservedGeneration == condition.ObservedGeneration &&
+		typed.Status.ObservedGeneration == obj.GetGeneration() {
+		return nil, nil
+	}
+	meta.SetStatusCondition(&typed.Status.Conditions, condition)
+	typed.Status.ObservedGeneration = obj.GetGeneration()
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&typed.Status)
+	if err != nil {
+		return nil, err
+	}
+	u := obj.DeepCopy()
+	if err = unstructured.SetNestedMap(u.Object, status, "status"); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// elect campaigns for the lease until ctx is done, the new leader reports the status of every object.
+func (c *Controller) elect(ctx context.Context) {
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            c.lock,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info().Msg("writing the status of the RateLimitConfig objects")
+				atomic.StoreInt32(&c.leading, 1)
+				c.reportAll()
+			},
+			OnStoppedLeading: func() {
+				atomic.StoreInt32(&c.leading, 0)
+			},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("leader election of the RateLimitConfig status failed")
+		return
+	}
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+}
+
+func (c *Controller) Run(ctx context.Context) error {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.client, time.Minute*15, c.namespace,
+		func(options *metav1.ListOptions) {
+			options.LabelSelector = c.selector
+		})
+	i := factory.ForResource(v1alpha1.GroupVersionResource).Informer()
+	i.AddEventHandler(c)
+	factory.Start(ctx.Done())
+	if c.lock != nil {
+		go c.elect(ctx)
+	}
+	if cache.WaitForCacheSync(ctx.Done(), i.HasSynced) {
+		c.mu.Lock()
+		c.synced = true
+		files := c.files()
+		c.mu.Unlock()
+		c.load(files)
+		c.reportAll()
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
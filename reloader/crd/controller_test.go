@@ -0,0 +1,263 @@
+package crd
+
+import (
+	"context"
+	"github.com/istio-conductor/shard-ratelimit/apis/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type loads struct {
+	mu    sync.Mutex
+	files []map[string][]byte
+	ch    chan map[string][]byte
+}
+
+func newLoads() *loads {
+	return &loads{ch: make(chan map[string][]byte, 10)}
+}
+
+func (l *loads) load(files map[string][]byte) {
+	l.mu.Lock()
+	l.files = append(l.files, files)
+	l.mu.Unlock()
+	l.ch <- files
+}
+
+func (l *loads) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.files)
+}
+
+type statuses struct {
+	mu sync.Mutex
+	m  map[string]status
+}
+
+type status struct {
+	ok       bool
+	lastGood bool
+	message  string
+}
+
+func (s *statuses) set(name string, st status) {
+	s.mu.Lock()
+	s.m[name] = st
+	s.mu.Unlock()
+}
+
+func (s *statuses) get(name string) (bool, bool, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.m[name]
+	if !ok {
+		return true, false, ""
+	}
+	return st.ok, st.lastGood, st.message
+}
+
+func object(name string, generation int64, requests int64) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": v1alpha1.Group + "/" + v1alpha1.Version,
+		"kind":       v1alpha1.Kind,
+		"metadata": map[string]interface{}{
+			"name":       name,
+			"namespace":  "ns",
+			"generation": generation,
+		},
+		"spec": map[string]interface{}{
+			"domain": name,
+			"descriptors": []interface{}{map[string]interface{}{
+				"key":        "k",
+				"rate_limit": map[string]interface{}{"unit": "second", "requests_per_unit": requests},
+			}},
+		},
+	}}
+}
+
+func newTestController(t *testing.T, objects ...runtime.Object) (*Controller, *fake.FakeDynamicClient, *loads, *statuses) {
+	t.Helper()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{v1alpha1.GroupVersionResource: v1alpha1.Kind + "List"}, objects...)
+	l := newLoads()
+	s := &statuses{m: map[string]status{}}
+	return NewWithClient(client, "ns", "", l.load, s.get), client, l, s
+}
+
+func loaded(t *testing.T, client *fake.FakeDynamicClient, name string) *metav1.Condition {
+	t.Helper()
+	u, err := client.Resource(v1alpha1.GroupVersionResource).Namespace("ns").Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var typed v1alpha1.RateLimitConfig
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &typed); err != nil {
+		t.Fatal(err)
+	}
+	return meta.FindStatusCondition(typed.Status.Conditions, v1alpha1.ConditionLoaded)
+}
+
+func create(t *testing.T, client *fake.FakeDynamicClient, obj *unstructured.Unstructured) {
+	t.Helper()
+	if _, err := client.Resource(v1alpha1.GroupVersionResource).Namespace("ns").Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunLoadsTheInitialObjects(t *testing.T) {
+	c, client, l, _ := newTestController(t, object("a", 1, 10), object("b", 1, 20))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = c.Run(ctx) }()
+
+	var files map[string][]byte
+	select {
+	case files = <-l.ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the initial objects were not loaded")
+	}
+	if len(files) != 2 || !strings.Contains(string(files["crd/ns/a.yaml"]), "domain: a") || !strings.Contains(string(files["crd/ns/b.yaml"]), "domain: b") {
+		t.Fatalf("loaded %v, want crd/ns/a.yaml and crd/ns/b.yaml at once", files)
+	}
+	// the statuses are reported after the load.
+	for _, name := range []string{"a", "b"} {
+		deadline := time.Now().Add(5 * time.Second)
+		condition := loaded(t, client, name)
+		for (condition == nil || condition.Status != metav1.ConditionTrue) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			condition = loaded(t, client, name)
+		}
+		if condition == nil || condition.Status != metav1.ConditionTrue {
+			t.Errorf("%s: condition %v, want Loaded true", name, condition)
+		}
+	}
+}
+
+func TestAddUpdateDelete(t *testing.T) {
+	c, client, l, _ := newTestController(t)
+	c.synced = true
+	a := object("a", 1, 10)
+	create(t, client, a)
+
+	c.OnAdd(a)
+	if files := <-l.ch; !strings.Contains(string(files["crd/ns/a.yaml"]), "requests_per_unit: 10") {
+		t.Errorf("add loaded %s, want the spec of a", files["crd/ns/a.yaml"])
+	}
+
+	updated := object("a", 2, 20)
+	c.OnUpdate(a, updated)
+	if files := <-l.ch; !strings.Contains(string(files["crd/ns/a.yaml"]), "requests_per_unit: 20") {
+		t.Errorf("update loaded %s, want the new spec of a", files["crd/ns/a.yaml"])
+	}
+
+	c.OnUpdate(updated, updated.DeepCopy())
+	if n := l.count(); n != 2 {
+		t.Errorf("an unchanged spec loaded again, %d loads, want 2", n)
+	}
+
+	c.OnDelete(updated)
+	if files := <-l.ch; len(files) != 0 {
+		t.Errorf("delete loaded %v, want no files", files)
+	}
+}
+
+func TestStatusConditions(t *testing.T) {
+	tests := []struct {
+		name   string
+		status status
+		want   metav1.Condition
+	}{
+		{"loaded", status{ok: true},
+			metav1.Condition{Status: metav1.ConditionTrue, Reason: v1alpha1.ReasonLoaded, Message: "config loaded"}},
+		{"invalid", status{message: "bad unit"},
+			metav1.Condition{Status: metav1.ConditionFalse, Reason: v1alpha1.ReasonInvalid, Message: "bad unit"}},
+		{"last good", status{lastGood: true, message: "bad unit"},
+			metav1.Condition{Status: metav1.ConditionFalse, Reason: v1alpha1.ReasonLastGood, Message: "bad unit"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, client, l, s := newTestController(t)
+			c.synced = true
+			a := object("a", 3, 10)
+			create(t, client, a)
+			s.set("crd/ns/a.yaml", test.status)
+
+			c.OnAdd(a)
+			<-l.ch
+			condition := loaded(t, client, "a")
+			if condition == nil {
+				t.Fatal("no Loaded condition")
+			}
+			if condition.Status != test.want.Status || condition.Reason != test.want.Reason || condition.Message != test.want.Message {
+				t.Errorf("condition %s %s %q, want %s %s %q", condition.Status, condition.Reason, condition.Message,
+					test.want.Status, test.want.Reason, test.want.Message)
+			}
+			if condition.ObservedGeneration != 3 {
+				t.Errorf("observed generation %d, want 3", condition.ObservedGeneration)
+			}
+		})
+	}
+}
+
+func TestStatusRetriesOnConflict(t *testing.T) {
+	c, client, l, _ := newTestController(t)
+	c.synced = true
+	a := object("a", 1, 10)
+	create(t, client, a)
+	conflicts := 0
+	client.PrependReactor("update", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, errors.NewConflict(v1alpha1.GroupVersionResource.GroupResource(), "a", nil)
+	})
+
+	c.OnAdd(a)
+	<-l.ch
+	if conflicts != 1 {
+		t.Fatalf("%d conflicts, want 1", conflicts)
+	}
+	if condition := loaded(t, client, "a"); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Errorf("condition %v after a conflict, want Loaded true", condition)
+	}
+}
+
+func TestOnlyTheLeaderWritesTheStatus(t *testing.T) {
+	c, client, l, _ := newTestController(t)
+	c.synced = true
+	c.lock = &resourcelock.LeaseLock{}
+	a := object("a", 1, 10)
+	create(t, client, a)
+
+	c.OnAdd(a)
+	<-l.ch
+	if condition := loaded(t, client, "a"); condition != nil {
+		t.Errorf("a follower wrote %v", condition)
+	}
+
+	c.leading = 1
+	c.reportAll()
+	if condition := loaded(t, client, "a"); condition == nil || condition.Status != metav1.ConditionTrue {
+		t.Errorf("condition %v of the leader, want Loaded true", condition)
+	}
+}
+
+func TestFileNameIsYaml(t *testing.T) {
+	obj := object("limits.csv", 1, 10)
+	if name := fileName(obj); name != "crd/ns/limits.csv.yaml" {
+		t.Errorf("file name %s, want crd/ns/limits.csv.yaml", name)
+	}
+}
@@ -10,19 +10,25 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 var ErrUnknown = errors.New("unknown error")
 
+// the delay after the last event before reloading.
+const debounce = 200 * time.Millisecond
+
 type Reloader struct {
-	dir  string
-	load func(files map[string][]byte)
+	dir      string
+	debounce time.Duration
+	load     func(files map[string][]byte)
 }
 
 func New(dir string, load func(files map[string][]byte)) (*Reloader, error) {
 	r := &Reloader{
-		dir:  dir,
-		load: load,
+		dir:      dir,
+		debounce: debounce,
+		load:     load,
 	}
 	err := os.MkdirAll(dir, os.ModeDir|0755)
 	if err != nil {
@@ -32,27 +38,57 @@ func New(dir string, load func(files map[string][]byte)) (*Reloader, error) {
 	return r, nil
 }
 
+// watch adds dir and its not hidden subdirectories to the watcher.
+func watch(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// Watch reloads on any change under the directory. Kubernetes volumes are updated by swapping the ..data
+// symlink, which shows up as create, rename and remove events, so every event counts and bursts of them are
+// collapsed into one reload after the debounce delay.
 func (r *Reloader) Watch(ctx context.Context) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
 	defer watcher.Close()
-	err = watcher.Add(r.dir)
+	err = watch(watcher, r.dir)
 	if err != nil {
 		return err
 	}
+	timer := time.NewTimer(r.debounce)
+	timer.Stop()
+	defer timer.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case event, ok := <-watcher.Events:
 			if !ok {
-				return errors.New("unknown error")
+				return ErrUnknown
 			}
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				r.LoadOnce()
+			log.Debug().Msgf("watch event: %s", event)
+			if event.Op&fsnotify.Create == fsnotify.Create && !strings.HasPrefix(filepath.Base(event.Name), ".") {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					if err = watch(watcher, event.Name); err != nil {
+						log.Error().Err(err).Msgf("watch %s failed", event.Name)
+					}
+				}
 			}
+			timer.Reset(r.debounce)
+		case <-timer.C:
+			r.LoadOnce()
 		case err, ok := <-watcher.Errors:
 			if !ok {
 				return ErrUnknown
@@ -67,15 +103,32 @@ func (r *Reloader) LoadOnce() {
 }
 
 func (r *Reloader) files() map[string][]byte {
+	return ReadDir(r.dir)
+}
+
+// ReadDir reads the regular, not hidden files under dir. Symlinks to files are followed, as Kubernetes
+// mounts configmap keys as links into the hidden ..data directory, which itself is skipped.
+func ReadDir(dir string) map[string][]byte {
 	m := map[string][]byte{}
-	_ = filepath.WalkDir(r.dir, func(path string, d fs.DirEntry, err error) error {
-		if d.IsDir() {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
 			return nil
 		}
-		if !d.Type().IsRegular() {
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		if strings.HasPrefix(d.Name(), ".") {
+		if d.IsDir() {
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		} else if !d.Type().IsRegular() {
 			return nil
 		}
 		data, err := ioutil.ReadFile(path)
@@ -0,0 +1,44 @@
+package replicas
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Authorize adds the shared token of the replicas to a request to a peer.
+func Authorize(request *http.Request, token string) {
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Authorized wraps handler to only serve the peers. With a token the requests must carry it as bearer
+// token, without one they must come from a known member.
+func Authorized(token string, members func() []string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !authorized(token, members, request) {
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func authorized(token string, members func() []string, request *http.Request) bool {
+	if token != "" {
+		given := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	for _, member := range members() {
+		if member == host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package replicas
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DemandPath = "/demand"
+
+// changes of the shares below this are not worth a reload.
+const demandTolerance = 0.05
+
+// Demand polls the hits per domain of every replica and reports the share of the hits per zone,
+// smoothed over the polls.
+type Demand struct {
+	zones    func() map[string]string
+	port     int
+	interval time.Duration
+	client   *http.Client
+	onUpdate func(demand map[string]map[string]float64)
+
+	last     map[string]map[string]int64
+	shares   map[string]map[string]float64
+	reported map[string]map[string]float64
+}
+
+func NewDemand(zones func() map[string]string, port int, interval time.Duration, onUpdate func(demand map[string]map[string]float64)) *Demand {
+	return &Demand{
+		zones:    zones,
+		port:     port,
+		interval: interval,
+		client:   &http.Client{Timeout: interval / 2},
+		onUpdate: onUpdate,
+		last:     map[string]map[string]int64{},
+		shares:   map[string]map[string]float64{},
+	}
+}
+
+// DemandHandler serves the hits per domain of this replica.
+func DemandHandler(hits func() map[string]int64) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(hits())
+	})
+}
+
+func (d *Demand) fetch(ctx context.Context, member string) (map[string]int64, error) {
+	u := "http://" + net.JoinHostPort(member, strconv.Itoa(d.port)) + DemandPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	hits := map[string]int64{}
+	err = json.NewDecoder(resp.Body).Decode(&hits)
+	return hits, err
+}
+
+func (d *Demand) poll(ctx context.Context) {
+	hits := map[string]map[string]float64{}
+	last := map[string]map[string]int64{}
+	for member, zone := range d.zones() {
+		if zone == "" {
+			continue
+		}
+		current, err := d.fetch(ctx, member)
+		if err != nil {
+			log.Debug().Err(err).Msgf("fetch demand of %s failed", member)
+			continue
+		}
+		last[member] = current
+		previous, ok := d.last[member]
+		if !ok {
+			continue
+		}
+		for domain, n := range current {
+			delta := n - previous[domain]
+			if delta <= 0 {
+				continue
+			}
+			if hits[domain] == nil {
+				hits[domain] = map[string]float64{}
+			}
+			hits[domain][zone] += float64(delta)
+		}
+	}
+	d.last = last
+
+	for domain, zones := range hits {
+		var total float64
+		for _, n := range zones {
+			total += n
+		}
+		shares := d.shares[domain]
+		if shares == nil {
+			shares = map[string]float64{}
+			d.shares[domain] = shares
+		}
+		for zone := range shares {
+			shares[zone] /= 2
+		}
+		for zone, n := range zones {
+			shares[zone] += n / total / 2
+		}
+	}
+	if d.changed() {
+		d.reported = copyShares(d.shares)
+		d.onUpdate(d.reported)
+	}
+}
+
+func (d *Demand) changed() bool {
+	if len(d.reported) != len(d.shares) {
+		return true
+	}
+	for domain, shares := range d.shares {
+		reported := d.reported[domain]
+		if len(reported) != len(shares) {
+			return true
+		}
+		for zone, share := range shares {
+			if math.Abs(reported[zone]-share) > demandTolerance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func copyShares(m map[string]map[string]float64) map[string]map[string]float64 {
+	c := make(map[string]map[string]float64, len(m))
+	for domain, shares := range m {
+		c[domain] = make(map[string]float64, len(shares))
+		for zone, share := range shares {
+			c[domain][zone] = share
+		}
+	}
+	return c
+}
+
+func (d *Demand) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			d.poll(ctx)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package replicas
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// members keeps the current member list and reports changes of its size.
+type members struct {
+	list     atomic.Value
+	onUpdate func(num int32)
+}
+
+func (m *members) Members() []string {
+	list, _ := m.list.Load().([]string)
+	return list
+}
+
+func (m *members) set(list []string) {
+	sort.Strings(list)
+	previous := m.Members()
+	if previous != nil && reflect.DeepEqual(previous, list) {
+		return
+	}
+	m.list.Store(list)
+	log.Info().Msgf("members: %v", list)
+	if len(previous) != len(list) || previous == nil {
+		m.onUpdate(int32(len(list)))
+	}
+}
+
+// DNS polls the A records of a headless name, or the SRV records when srv is set.
+type DNS struct {
+	members
+	name     string
+	srv      bool
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+func NewDNS(name string, srv bool, interval time.Duration, onUpdate func(replicas int32)) (*DNS, error) {
+	d := &DNS{
+		members:  members{onUpdate: onUpdate},
+		name:     name,
+		srv:      srv,
+		interval: interval,
+		resolver: net.DefaultResolver,
+	}
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	list, err := d.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.set(list)
+	return d, nil
+}
+
+func (d *DNS) lookup(ctx context.Context) ([]string, error) {
+	if !d.srv {
+		return d.resolver.LookupHost(ctx, d.name)
+	}
+	_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, record := range records {
+		hosts, err := d.resolver.LookupHost(ctx, strings.TrimSuffix(record.Target, "."))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, hosts...)
+	}
+	return list, nil
+}
+
+func (d *DNS) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			list, err := d.lookup(ctx)
+			if err != nil {
+				log.Error().Err(err).Msgf("lookup %s failed", d.name)
+				continue
+			}
+			d.set(list)
+		}
+	}
+}
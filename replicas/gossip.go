@@ -0,0 +1,231 @@
+package replicas
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const GossipPath = "/gossip"
+
+var ErrNoSelf = errors.New("gossip needs the ip of this instance")
+
+// number of members a node gossips with per round.
+const fanout = 3
+
+type heartbeat struct {
+	Count int64 `json:"count"`
+	seen  time.Time
+	// dead marks the tombstone of an expired member, which only a higher count brings back.
+	dead bool
+}
+
+// Gossip is a push-pull heartbeat protocol among the instances. Every round a node bumps its own
+// heartbeat and exchanges its member table with a few random members and the seeds. Members whose
+// heartbeat does not advance within timeout are considered gone. Without a token only the seeds are admitted
+// as members, since anyone could gossip made up ones.
+type Gossip struct {
+	members
+	self     string
+	seeds    []string
+	port     int
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+	token    string
+
+	mu    sync.Mutex
+	table map[string]*heartbeat
+}
+
+func NewGossip(self string, seeds []string, port int, interval time.Duration, onUpdate func(replicas int32)) (*Gossip, error) {
+	if self == "" {
+		return nil, ErrNoSelf
+	}
+	g := &Gossip{
+		members:  members{onUpdate: onUpdate},
+		self:     self,
+		seeds:    seeds,
+		port:     port,
+		interval: interval,
+		timeout:  interval * 5,
+		client:   &http.Client{Timeout: interval},
+		// start from the clock so the heartbeat of a restarted instance supersedes its old one.
+		table: map[string]*heartbeat{self: {Count: time.Now().UnixNano(), seen: time.Now()}},
+	}
+	g.set([]string{self})
+	return g, nil
+}
+
+// WithToken authenticates the gossip with the shared token of the replicas, admitting any member.
+func (g *Gossip) WithToken(token string) *Gossip {
+	g.token = token
+	return g
+}
+
+func (g *Gossip) snapshot() map[string]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	m := make(map[string]int64, len(g.table))
+	for member, hb := range g.table {
+		if !hb.dead {
+			m[member] = hb.Count
+		}
+	}
+	return m
+}
+
+func (g *Gossip) admitted(member string) bool {
+	if g.token != "" {
+		return true
+	}
+	for _, seed := range g.seeds {
+		if seed == member {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gossip) merge(remote map[string]int64) {
+	now := time.Now()
+	g.mu.Lock()
+	for member, count := range remote {
+		if member == g.self || !g.admitted(member) {
+			continue
+		}
+		hb, ok := g.table[member]
+		if !ok {
+			g.table[member] = &heartbeat{Count: count, seen: now}
+			continue
+		}
+		if count > hb.Count {
+			hb.Count = count
+			hb.seen = now
+			hb.dead = false
+		}
+	}
+	g.mu.Unlock()
+}
+
+// expire turns the members whose heartbeat didn't advance within timeout into tombstones, which are dropped
+// once the other members stopped gossiping them too.
+func (g *Gossip) expire() {
+	now := time.Now()
+	g.mu.Lock()
+	var list []string
+	for member, hb := range g.table {
+		if member != g.self && now.Sub(hb.seen) > g.timeout {
+			if now.Sub(hb.seen) > 2*g.timeout {
+				delete(g.table, member)
+			} else {
+				hb.dead = true
+			}
+			continue
+		}
+		list = append(list, member)
+	}
+	g.mu.Unlock()
+	g.set(list)
+}
+
+func (g *Gossip) targets() []string {
+	g.mu.Lock()
+	var known []string
+	for member, hb := range g.table {
+		if member != g.self && !hb.dead {
+			known = append(known, member)
+		}
+	}
+	g.mu.Unlock()
+	rand.Shuffle(len(known), func(i, j int) {
+		known[i], known[j] = known[j], known[i]
+	})
+	if len(known) > fanout {
+		known = known[:fanout]
+	}
+	for _, seed := range g.seeds {
+		if seed != g.self {
+			known = append(known, seed)
+		}
+	}
+	return known
+}
+
+func (g *Gossip) exchange(ctx context.Context, member string) error {
+	body, err := json.Marshal(g.snapshot())
+	if err != nil {
+		return err
+	}
+	u := "http://" + net.JoinHostPort(member, strconv.Itoa(g.port)) + GossipPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	Authorize(req, g.token)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	remote := map[string]int64{}
+	if err = json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return err
+	}
+	g.merge(remote)
+	return nil
+}
+
+// ServeHTTP merges the member table of a peer and answers with the local one.
+func (g *Gossip) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if g.token != "" && !authorized(g.token, nil, request) {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	remote := map[string]int64{}
+	if err := json.NewDecoder(request.Body).Decode(&remote); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.merge(remote)
+	writer.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(writer).Encode(g.snapshot())
+}
+
+func (g *Gossip) round(ctx context.Context) {
+	g.mu.Lock()
+	self := g.table[g.self]
+	self.Count++
+	self.seen = time.Now()
+	g.mu.Unlock()
+	for _, member := range g.targets() {
+		if err := g.exchange(ctx, member); err != nil {
+			log.Debug().Err(err).Msgf("gossip with %s failed", member)
+		}
+	}
+	g.expire()
+}
+
+func (g *Gossip) Run(ctx context.Context) error {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			g.round(ctx)
+		}
+	}
+}
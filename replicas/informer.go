@@ -17,16 +17,26 @@ type Replicas struct {
 	name      string
 	kube      kubernetes.Interface
 	num       int32
+	members   atomic.Value
 	onUpdate  func(num int32)
 }
 
+func addresses(ep *corev1.Endpoints) []string {
+	var members []string
+	for _, subset := range ep.Subsets {
+		for _, address := range subset.Addresses {
+			members = append(members, address.IP)
+		}
+		break
+	}
+	return members
+}
+
 func (r *Replicas) OnAdd(obj interface{}) {
 	if ep, ok := obj.(*corev1.Endpoints); ok {
-		num := 0
-		for _, subset := range ep.Subsets {
-			num = len(subset.Addresses)
-			break
-		}
+		members := addresses(ep)
+		num := len(members)
+		r.members.Store(members)
 		if atomic.LoadInt32(&r.num) != int32(num) {
 			atomic.StoreInt32(&r.num, int32(num))
 			r.onUpdate(int32(num))
@@ -58,25 +68,30 @@ func New(namespace string, name string, onUpdate func(replicas int32)) (r *Repli
 	if err != nil {
 		return nil, err
 	}
-	num := 0
-	for _, subset := range endpoints.Subsets {
-		num = len(subset.Addresses)
-		break
-	}
+	members := addresses(endpoints)
+	num := len(members)
 	onUpdate(int32(num))
-	return &Replicas{
+	r = &Replicas{
 		namespace: namespace,
 		name:      name,
 		kube:      k,
 		num:       int32(num),
 		onUpdate:  onUpdate,
-	}, nil
+	}
+	r.members.Store(members)
+	return r, nil
 }
 
 func (r *Replicas) Get() int {
 	return int(atomic.LoadInt32(&r.num))
 }
 
+// Members returns the ip addresses of the ready replicas.
+func (r *Replicas) Members() []string {
+	members, _ := r.members.Load().([]string)
+	return members
+}
+
 func (r *Replicas) Run(ctx context.Context) error {
 	factory := informers.NewSharedInformerFactoryWithOptions(r.kube, time.Minute*15,
 		informers.WithNamespace(r.namespace), informers.WithTweakListOptions(func(options *v1.ListOptions) {
@@ -0,0 +1,77 @@
+package replicas
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/rs/zerolog/log"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Static is a fixed list of peers, optionally read from a file with one peer per line
+// which is polled for changes.
+type Static struct {
+	members
+	file     string
+	interval time.Duration
+	content  []byte
+}
+
+func NewStatic(peers []string, file string, interval time.Duration, onUpdate func(replicas int32)) (*Static, error) {
+	s := &Static{
+		members:  members{onUpdate: onUpdate},
+		file:     file,
+		interval: interval,
+	}
+	if file == "" {
+		s.set(append([]string(nil), peers...))
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Static) load() error {
+	content, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	if s.content != nil && bytes.Equal(content, s.content) {
+		return nil
+	}
+	s.content = content
+	var list []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	s.set(list)
+	return nil
+}
+
+func (s *Static) Run(ctx context.Context) error {
+	if s.file == "" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := s.load(); err != nil {
+				log.Error().Err(err).Msgf("load peers from %s failed", s.file)
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package replicas
+
+import (
+	"context"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/rs/zerolog/log"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+import clientconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
+
+const zoneLabel = "topology.kubernetes.io/zone"
+
+// nodeRetry is the time before looking up the zone of a node again after a failure.
+const nodeRetry = time.Minute
+
+// Topology watches the EndpointSlices of the service and reports the ready replicas per zone.
+// The zone of an endpoint is taken from its zone field, its hints or the labels of its node.
+type Topology struct {
+	namespace string
+	name      string
+	self      string
+	kube      kubernetes.Interface
+	onUpdate  func(topology config.Topology)
+
+	mu      sync.Mutex
+	slices  map[string]*discoveryv1.EndpointSlice
+	nodes   map[string]string
+	failed  map[string]time.Time
+	current config.Topology
+	members atomic.Value
+	zones   atomic.Value
+}
+
+func NewTopology(namespace string, name string, self string, onUpdate func(topology config.Topology)) (*Topology, error) {
+	c, err := clientconfig.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	k, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	t := &Topology{
+		namespace: namespace,
+		name:      name,
+		self:      self,
+		kube:      k,
+		onUpdate:  onUpdate,
+		slices:    map[string]*discoveryv1.EndpointSlice{},
+		nodes:     map[string]string{},
+		failed:    map[string]time.Time{},
+	}
+	t.members.Store([]string(nil))
+	t.zones.Store(map[string]string{})
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	list, err := k.DiscoveryV1().EndpointSlices(namespace).List(ctx, t.listOptions())
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	for i := range list.Items {
+		t.slices[list.Items[i].Name] = &list.Items[i]
+	}
+	t.mu.Unlock()
+	topology, _ := t.recompute()
+	onUpdate(topology)
+	return t, nil
+}
+
+func (t *Topology) listOptions() v1.ListOptions {
+	return v1.ListOptions{LabelSelector: discoveryv1.LabelServiceName + "=" + t.name}
+}
+
+// endpointZone returns the zone of the endpoint itself, empty when only its node knows it.
+func endpointZone(endpoint discoveryv1.Endpoint) string {
+	if endpoint.Zone != nil && *endpoint.Zone != "" {
+		return *endpoint.Zone
+	}
+	if endpoint.Hints != nil && len(endpoint.Hints.ForZones) > 0 {
+		return endpoint.Hints.ForZones[0].Name
+	}
+	return ""
+}
+
+// zone must be called with mu held.
+func (t *Topology) zone(endpoint discoveryv1.Endpoint) string {
+	if zone := endpointZone(endpoint); zone != "" {
+		return zone
+	}
+	if endpoint.NodeName != nil {
+		return t.nodes[*endpoint.NodeName]
+	}
+	return ""
+}
+
+// missingNodes returns the nodes whose zone is needed and not known yet, it must be called with mu held.
+func (t *Topology) missingNodes() []string {
+	now := time.Now()
+	var nodes []string
+	seen := map[string]bool{}
+	for _, slice := range t.slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName == nil || endpointZone(endpoint) != "" {
+				continue
+			}
+			node := *endpoint.NodeName
+			if _, ok := t.nodes[node]; ok || seen[node] || now.Before(t.failed[node]) {
+				continue
+			}
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// resolveNodes looks up the zones of nodes without holding mu, the failed ones are retried after nodeRetry.
+func (t *Topology) resolveNodes(nodes []string) {
+	zones := map[string]string{}
+	var failed []string
+	for _, node := range nodes {
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+		n, err := t.kube.CoreV1().Nodes().Get(ctx, node, v1.GetOptions{})
+		cancel()
+		if err != nil {
+			log.Error().Err(err).Msgf("get zone of node %s failed", node)
+			failed = append(failed, node)
+			continue
+		}
+		zones[node] = n.Labels[zoneLabel]
+	}
+	retry := time.Now().Add(nodeRetry)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node, zone := range zones {
+		t.nodes[node] = zone
+		delete(t.failed, node)
+	}
+	for _, node := range failed {
+		t.failed[node] = retry
+	}
+}
+
+// recompute resolves the missing zones and computes the topology, reporting whether it changed.
+func (t *Topology) recompute() (config.Topology, bool) {
+	t.mu.Lock()
+	nodes := t.missingNodes()
+	t.mu.Unlock()
+	if len(nodes) > 0 {
+		t.resolveNodes(nodes)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	topology := t.compute()
+	changed := !reflect.DeepEqual(topology, t.current)
+	t.current = topology
+	return topology, changed
+}
+
+// compute must be called with mu held.
+func (t *Topology) compute() config.Topology {
+	topology := config.Topology{Zones: map[string]int32{}}
+	zones := map[string]string{}
+	var members []string
+	for _, slice := range t.slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			if len(endpoint.Addresses) == 0 {
+				continue
+			}
+			address := endpoint.Addresses[0]
+			if _, dup := zones[address]; dup {
+				continue
+			}
+			zone := t.zone(endpoint)
+			zones[address] = zone
+			members = append(members, address)
+			topology.Replicas++
+			if zone != "" {
+				topology.Zones[zone]++
+			}
+			if address == t.self {
+				topology.Zone = zone
+			}
+		}
+	}
+	sort.Strings(members)
+	t.members.Store(members)
+	t.zones.Store(zones)
+	return topology
+}
+
+func (t *Topology) update(obj interface{}, deleted bool) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			slice, ok = tombstone.Obj.(*discoveryv1.EndpointSlice)
+		}
+		if !ok {
+			return
+		}
+	}
+	t.mu.Lock()
+	if deleted {
+		delete(t.slices, slice.Name)
+	} else {
+		t.slices[slice.Name] = slice
+	}
+	t.mu.Unlock()
+	if topology, changed := t.recompute(); changed {
+		log.Info().Msgf("topology: replicas %d, zone %s, zones %v", topology.Replicas, topology.Zone, topology.Zones)
+		t.onUpdate(topology)
+	}
+}
+
+func (t *Topology) OnAdd(obj interface{}) {
+	t.update(obj, false)
+}
+
+func (t *Topology) OnUpdate(oldObj, obj interface{}) {
+	t.update(obj, false)
+}
+
+func (t *Topology) OnDelete(obj interface{}) {
+	t.update(obj, true)
+}
+
+// Members returns the ip addresses of the ready replicas.
+func (t *Topology) Members() []string {
+	return t.members.Load().([]string)
+}
+
+// Zones returns the zone of the ready replicas by ip address.
+func (t *Topology) Zones() map[string]string {
+	return t.zones.Load().(map[string]string)
+}
+
+func (t *Topology) Run(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(t.kube, time.Minute*15,
+		informers.WithNamespace(t.namespace), informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.LabelSelector = t.listOptions().LabelSelector
+		}))
+	i := factory.Discovery().V1().EndpointSlices().Informer()
+	i.AddEventHandler(t)
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	return ctx.Err()
+}
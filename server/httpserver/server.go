@@ -11,6 +11,8 @@ import (
 
 var health = atomic.NewBool(false)
 
+var ready = atomic.NewBool(true)
+
 func Health() {
 	health.Store(true)
 }
@@ -19,6 +21,16 @@ func NotHealth() {
 	health.Store(false)
 }
 
+// Ready marks the instance ready to serve, healthy instances are ready unless marked otherwise.
+func Ready(ok bool) {
+	ready.Store(ok)
+}
+
+// Handle registers an additional handler on the http server.
+func Handle(pattern string, handler http.Handler) {
+	http.Handle(pattern, handler)
+}
+
 func Run(ctx context.Context, HTTPPort int) error {
 	server := &http.Server{Addr: ":" + strconv.Itoa(HTTPPort)}
 	http.Handle("/metrics", promhttp.Handler())
@@ -32,6 +44,15 @@ func Run(ctx context.Context, HTTPPort int) error {
 		_, _ = writer.Write([]byte("not ok"))
 		return
 	})
+	http.HandleFunc("/ready", func(writer http.ResponseWriter, request *http.Request) {
+		if health.Load() && ready.Load() {
+			writer.WriteHeader(200)
+			_, _ = writer.Write([]byte("ok"))
+			return
+		}
+		writer.WriteHeader(500)
+		_, _ = writer.Write([]byte("not ready"))
+	})
 	go func() {
 		<-ctx.Done()
 		_ = server.Shutdown(context.TODO())
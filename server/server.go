@@ -2,18 +2,36 @@ package server
 
 import (
 	"context"
+	"errors"
 	v3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/istio-conductor/shard-ratelimit/borrow"
 	"github.com/istio-conductor/shard-ratelimit/bucket"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/override"
 	"github.com/istio-conductor/shard-ratelimit/prom"
 	"github.com/istio-conductor/shard-ratelimit/ratelimit"
+	"github.com/istio-conductor/shard-ratelimit/reconcile"
+	"github.com/istio-conductor/shard-ratelimit/redis"
 	"github.com/istio-conductor/shard-ratelimit/reloader"
 	"github.com/istio-conductor/shard-ratelimit/reloader/configmap"
+	"github.com/istio-conductor/shard-ratelimit/reloader/crd"
 	"github.com/istio-conductor/shard-ratelimit/replicas"
 	"github.com/istio-conductor/shard-ratelimit/server/httpserver"
+	"github.com/mediocregopher/radix/v3"
+	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"net"
+	"os"
 	"strconv"
+	"time"
+)
+
+var (
+	ErrUnknownMode      = errors.New("unknown mode")
+	ErrUnknownStore     = errors.New("unknown reconcile store")
+	ErrNoRedis          = errors.New("redis is not configured")
+	ErrUnknownDiscovery = errors.New("unknown discovery")
 )
 
 type Server struct {
@@ -24,8 +42,72 @@ type Server struct {
 	HTTPPort  int
 	Dir       string
 	ConfigMap string
+
+	ConfigMapSelector      string
+	ConfigMapAllNamespaces bool
+	// ConfigMapPolicy is applied when the configmap is deleted or doesn't exist.
+	ConfigMapPolicy configmap.Policy
+
+	// AdminToken enables the admin API, authenticated with it as bearer token.
+	AdminToken string
+	// OverrideConfigMap shares the runtime overrides among the replicas, they are local without it.
+	OverrideConfigMap string
+
+	PodIP string
+	// PeerToken authenticates the requests among the replicas, only the known members are served without it.
+	PeerToken     string
+	Borrow        bool
+	BorrowTimeout time.Duration
+	BorrowLease   time.Duration
+	BorrowSize    int
+
+	RedisURL          string
+	RedisPerSecondURL string
+	RedisPoolSize     int
+	RedisPrefix       string
+
+	Mode              string
+	ReconcileInterval time.Duration
+	ReconcileStore    string
+
+	ZoneAware      bool
+	DemandInterval time.Duration
+
+	Discovery         string
+	DiscoveryInterval time.Duration
+	DNSName           string
+	DNSSRV            bool
+	Peers             []string
+	PeersFile         string
+
+	StrictConfig bool
+	// PenaltyEntries bounds the values the penalties remember.
+	PenaltyEntries int
+	// MaxWaiters bounds the requests waiting for a token at once.
+	MaxWaiters int
+	// UnknownDomain is the policy of the domains missing from the config, allow or deny.
+	UnknownDomain string
+	// DefaultLimit limits the descriptors without a limit, like 100/second, none when empty.
+	DefaultLimit string
+
+	CRD          bool
+	CRDNamespace string
+	CRDSelector  string
 }
 
+const (
+	ModeLocal  = "local"
+	ModeHybrid = "hybrid"
+
+	StorePeers = "peers"
+	StoreRedis = "redis"
+
+	DiscoveryKubernetes = "kubernetes"
+	DiscoveryDNS        = "dns"
+	DiscoveryStatic     = "static"
+	DiscoveryGossip     = "gossip"
+)
+
 func New(port int, httpPort int, dir string, ns, svc string, cm string, replicas int) *Server {
 	return &Server{Port: port, HTTPPort: httpPort, Dir: dir, Namespace: ns, Service: svc, ConfigMap: cm, Replicas: replicas}
 }
@@ -42,22 +124,98 @@ func (s *Server) Run(ctx context.Context) error {
 	server := grpc.NewServer(grpc.ChainUnaryInterceptor(prom.MiddleWare))
 
 	buckets := bucket.New()
+	if s.MaxWaiters > 0 {
+		buckets.WithMaxWaiters(s.MaxWaiters)
+	}
 
 	service := ratelimit.New(buckets)
-	if s.Replicas == 0 {
-		r, err := replicas.New(s.Namespace, s.Service, service.OnReplicasUpdate)
+	if s.StrictConfig {
+		service.WithStrict()
+	}
+	if s.PenaltyEntries > 0 {
+		service.WithPenaltyEntries(s.PenaltyEntries)
+	}
+	if s.UnknownDomain != "" {
+		if err = service.WithUnknownDomain(s.UnknownDomain); err != nil {
+			return err
+		}
+	}
+	if s.DefaultLimit != "" {
+		if err = service.WithDefaultLimit(s.DefaultLimit); err != nil {
+			return err
+		}
+	}
+	if s.AdminToken != "" {
+		httpserver.Handle("/config/status", override.Authorized(s.AdminToken, ratelimit.StatusHandler(service)))
+	} else {
+		httpserver.Handle("/config/status", ratelimit.StatusSummaryHandler(service))
+	}
+	httpserver.Handle("/config/schedules", ratelimit.SchedulesHandler(service))
+	group.Go(func() error {
+		return service.RunSchedules(ctx)
+	})
+	var redisClient radix.Client
+	if s.RedisURL != "" {
+		redisClient, err = redis.NewPool(s.RedisURL, s.RedisPoolSize, prom.RedisPool)
 		if err != nil {
 			return err
 		}
+		cache, err := s.redis(redisClient, buckets)
+		if err != nil {
+			return err
+		}
+		service.WithBackend(config.BackendRedis, cache)
+	}
+	members, err := s.membership(ctx, group, service)
+	if err != nil {
+		return err
+	}
+
+	switch s.Mode {
+	case ModeLocal, "":
+	case ModeHybrid:
+		var store reconcile.Store
+		switch s.ReconcileStore {
+		case StoreRedis:
+			if redisClient == nil {
+				return ErrNoRedis
+			}
+			store = reconcile.NewRedis(redisClient, s.RedisPrefix, s.ReconcileInterval)
+		case StorePeers:
+			peers := reconcile.NewPeers(s.PodIP, s.HTTPPort, members, s.ReconcileInterval/5).WithToken(s.PeerToken)
+			httpserver.Handle(reconcile.Path, replicas.Authorized(s.PeerToken, members, peers))
+			store = peers
+		default:
+			return ErrUnknownStore
+		}
+		buckets.WithCounting()
+		reconciler := reconcile.New(buckets, store, service.Replicas, s.ReconcileInterval)
 		group.Go(func() error {
-			return r.Run(ctx)
+			return reconciler.Run(ctx)
 		})
-	} else {
-		service.OnReplicasUpdate(int32(s.Replicas))
+	default:
+		return ErrUnknownMode
 	}
 
-	if s.ConfigMap != "" {
-		cm, err := configmap.New(s.Namespace, s.ConfigMap, service.OnConfigUpdate)
+	if s.Borrow {
+		buckets.WithBorrower(borrow.New(s.PodIP, s.HTTPPort, members, s.BorrowTimeout, s.BorrowLease, s.BorrowSize).WithToken(s.PeerToken))
+		httpserver.Handle(borrow.Path, replicas.Authorized(s.PeerToken, members, borrow.Handler(buckets)))
+	}
+
+	if s.ConfigMapSelector != "" {
+		namespace := s.Namespace
+		if s.ConfigMapAllNamespaces {
+			namespace = ""
+		}
+		cm, err := configmap.NewSelector(namespace, s.ConfigMapSelector, service.OnConfigUpdate)
+		if err != nil {
+			return err
+		}
+		group.Go(func() error {
+			return cm.Run(ctx)
+		})
+	} else if s.ConfigMap != "" {
+		cm, err := configmap.New(s.Namespace, s.ConfigMap, s.ConfigMapPolicy, service.OnConfigUpdate, httpserver.Ready)
 		if err != nil {
 			return err
 		}
@@ -75,6 +233,44 @@ func (s *Server) Run(ctx context.Context) error {
 		})
 	}
 
+	if s.AdminToken != "" {
+		onUpdate := func(state *override.State) {
+			service.OnOverrides(state.Overrides)
+			service.OnSwitches(state.Switches)
+		}
+		var store override.Store
+		if s.OverrideConfigMap != "" {
+			store, err = override.NewConfigMap(s.Namespace, s.OverrideConfigMap, onUpdate)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.Warn().Msg("overrides apply to this replica only without an override configmap")
+			store = override.NewMemory(onUpdate)
+		}
+		httpserver.Handle(override.Path, override.Authorized(s.AdminToken, override.Handler(store, service.CheckOverride)))
+		httpserver.Handle(override.SwitchPath, override.Authorized(s.AdminToken, override.SwitchHandler(store)))
+		httpserver.Handle(ratelimit.PenaltiesPath, override.Authorized(s.AdminToken, ratelimit.PenaltiesHandler(service)))
+		group.Go(func() error {
+			return store.Run(ctx)
+		})
+	}
+
+	if s.CRD {
+		controller, err := crd.New(s.CRDNamespace, s.CRDSelector, service.Source("crd"), service.Loaded)
+		if err != nil {
+			return err
+		}
+		identity, _ := os.Hostname()
+		if identity == "" {
+			identity = s.PodIP
+		}
+		controller.WithLeaderElection(s.Namespace, s.Service+"-crd-status", identity)
+		group.Go(func() error {
+			return controller.Run(ctx)
+		})
+	}
+
 	v3.RegisterRateLimitServiceServer(server, service)
 
 	group.Go(func() error {
@@ -95,3 +291,78 @@ func (s *Server) Run(ctx context.Context) error {
 
 	return group.Wait()
 }
+
+// membership starts tracking the replicas and returns their member list.
+func (s *Server) membership(ctx context.Context, group *errgroup.Group, service *ratelimit.Service) (func() []string, error) {
+	if s.Replicas != 0 {
+		service.OnReplicasUpdate(int32(s.Replicas))
+		return func() []string { return nil }, nil
+	}
+	var provider interface {
+		Members() []string
+		Run(ctx context.Context) error
+	}
+	switch s.Discovery {
+	case DiscoveryKubernetes, "":
+		if !s.ZoneAware {
+			r, err := replicas.New(s.Namespace, s.Service, service.OnReplicasUpdate)
+			if err != nil {
+				return nil, err
+			}
+			provider = r
+			break
+		}
+		t, err := replicas.NewTopology(s.Namespace, s.Service, s.PodIP, service.OnTopologyUpdate)
+		if err != nil {
+			return nil, err
+		}
+		provider = t
+		service.WithDemand()
+		httpserver.Handle(replicas.DemandPath, replicas.DemandHandler(service.Demand))
+		demand := replicas.NewDemand(t.Zones, s.HTTPPort, s.DemandInterval, service.OnDemandUpdate)
+		group.Go(func() error {
+			return demand.Run(ctx)
+		})
+	case DiscoveryDNS:
+		d, err := replicas.NewDNS(s.DNSName, s.DNSSRV, s.DiscoveryInterval, service.OnReplicasUpdate)
+		if err != nil {
+			return nil, err
+		}
+		provider = d
+	case DiscoveryStatic:
+		st, err := replicas.NewStatic(s.Peers, s.PeersFile, s.DiscoveryInterval, service.OnReplicasUpdate)
+		if err != nil {
+			return nil, err
+		}
+		provider = st
+	case DiscoveryGossip:
+		g, err := replicas.NewGossip(s.PodIP, s.Peers, s.HTTPPort, s.DiscoveryInterval, service.OnReplicasUpdate)
+		if err != nil {
+			return nil, err
+		}
+		if s.PeerToken == "" {
+			log.Warn().Msg("gossip only admits the seeds as members without a peer token")
+		}
+		g.WithToken(s.PeerToken)
+		httpserver.Handle(replicas.GossipPath, g)
+		provider = g
+	default:
+		return nil, ErrUnknownDiscovery
+	}
+	group.Go(func() error {
+		return provider.Run(ctx)
+	})
+	return provider.Members, nil
+}
+
+func (s *Server) redis(client radix.Client, fallback *bucket.Buckets) (*redis.Cache, error) {
+	var perSecond radix.Client
+	if s.RedisPerSecondURL != "" {
+		var err error
+		perSecond, err = redis.NewPool(s.RedisPerSecondURL, s.RedisPoolSize, prom.RedisPerSecondPool)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return redis.New(client, perSecond, s.RedisPrefix, fallback), nil
+}
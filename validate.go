@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/istio-conductor/shard-ratelimit/config"
+	"github.com/istio-conductor/shard-ratelimit/reloader"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+var validateCmd = &cobra.Command{
+	Use:          "validate [dir or file]...",
+	Short:        "Validate the config files, exiting non-zero on any error.",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files, err := readConfigs(args)
+		if err != nil {
+			return err
+		}
+		conf, errs := config.Load(config.Topology{Replicas: int32(Replicas)}, files, nil)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "ERROR", err)
+		}
+		for _, warning := range conf.Warnings() {
+			fmt.Fprintln(os.Stderr, "WARN", warning)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("%w: %d errors in %d files", ErrInvalidConfig, len(errs), len(files))
+		}
+		fmt.Printf("%d files ok\n", len(files))
+		return nil
+	},
+}
+
+// readConfigs reads the config files from a list of directories and files, the watching directory by default.
+func readConfigs(paths []string) ([]config.File, error) {
+	if len(paths) == 0 {
+		paths = []string{WatchDir}
+	}
+	m := map[string][]byte{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			for name, content := range reloader.ReadDir(path) {
+				m[name] = content
+			}
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		m[path] = content
+	}
+	files := make([]config.File, 0, len(m))
+	for name, content := range m {
+		files = append(files, config.File{Name: name, Content: content})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files, nil
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}